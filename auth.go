@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requestToken returns the auth token presented by r, either as a bearer
+// token in its Authorization header or in its token query parameter.
+func requestToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authorized returns whether r presents token.
+// If token is empty, auth is disabled, and every request is authorized.
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(requestToken(r)), []byte(token)) == 1
+}
+
+// requireAuth wraps h so that it responds 401 to requests not presenting
+// token.
+func requireAuth(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// requireAdmin wraps h, an admin API handler, so that it responds 401 to
+// requests not presenting token.  Unlike requireAuth, an empty token doesn't
+// disable auth: the admin API is then closed to everyone, with 403.
+func requireAdmin(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "Forbidden: the admin API needs authtoken to be set", http.StatusForbidden)
+			return
+		}
+		requireAuth(token, h)(w, r)
+	}
+}
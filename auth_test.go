@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// adminRoutes are the method and path of every admin API route.
+var adminRoutes = []struct{ method, path string }{
+	{"GET", "/admin/connections"},
+	{"POST", "/admin/reload"},
+	{"POST", "/admin/notify"},
+	{"POST", "/admin/servers/main/reconnect"},
+}
+
+// TestAdminNeedsToken checks that every admin route refuses requests without
+// the auth token, and is closed outright if no token is set.
+func TestAdminNeedsToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		authToken string
+		// header is the Authorization header sent, if not "".
+		header     string
+		wantStatus int
+	}{
+		{"no token set", "", "", http.StatusForbidden},
+		{"no token set, empty token presented", "", "Bearer ", http.StatusForbidden},
+		{"token not presented", "secret", "", http.StatusUnauthorized},
+		{"wrong token presented", "secret", "Bearer guess", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := defaultConfig().HTTP
+			conf.AuthToken = tt.authToken
+			wspool := startTestPool(t, conf)
+			h := initHTTP(conf, listener{Routes: []string{routeAdmin}}, time.Now(), newConnectorSet(), nil, wspool, nil, make(chan reloadRequest), testLogger())
+
+			for _, route := range adminRoutes {
+				req := httptest.NewRequest(route.method, route.path, nil)
+				if tt.header != "" {
+					req.Header.Set("Authorization", tt.header)
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				if rec.Code != tt.wantStatus {
+					t.Errorf("%s %s: got status %d, want %d", route.method, route.path, rec.Code, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+// TestAdminWithToken checks that the admin API lets in requests presenting
+// the auth token.
+func TestAdminWithToken(t *testing.T) {
+	conf := defaultConfig().HTTP
+	conf.AuthToken = "secret"
+	wspool := startTestPool(t, conf)
+	h := initHTTP(conf, listener{Routes: []string{routeAdmin}}, time.Now(), newConnectorSet(), nil, wspool, nil, nil, testLogger())
+
+	req := httptest.NewRequest("GET", "/admin/connections?token=secret", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want 200", rec.Code)
+	}
+}
+
+// TestValidateAdminRouteNeedsToken checks that a listener can't ask for the
+// admin routes without an auth token to protect them.
+func TestValidateAdminRouteNeedsToken(t *testing.T) {
+	conf := defaultConfig()
+	conf.Servers = map[string]server{"main": {Hostport: "localhost:1350"}}
+	conf.HTTP.Listeners = map[string]listener{
+		"internal": {Hostport: "127.0.0.1:3001", Routes: []string{routeAdmin}},
+	}
+	if err := conf.validate(); err == nil {
+		t.Error("admin route without authtoken validated")
+	}
+	conf.HTTP.AuthToken = "secret"
+	if err := conf.validate(); err != nil {
+		t.Errorf("admin route with authtoken didn't validate: %s", err)
+	}
+}
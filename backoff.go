@@ -0,0 +1,33 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes exponentially increasing delays between reconnection
+// attempts, starting at base and doubling up to max.
+//
+// Each delay is jittered, picked at random from between zero and the
+// exponential delay, so that connectors that lost a shared host at the same
+// time don't all redial it in lockstep when it comes back.
+type backoff struct {
+	base, max time.Duration
+	attempt   uint
+}
+
+// next returns the delay to wait before the next attempt.
+func (b *backoff) next() time.Duration {
+	d := b.base << b.attempt
+	if d <= 0 || b.max < d {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// reset returns the delay to base, for example after a successful attempt.
+func (b *backoff) reset() {
+	b.attempt = 0
+}
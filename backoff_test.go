@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBackoffBounds checks that delays stay within [0, cap], and that their
+// bound grows with repeated failures.
+func TestBackoffBounds(t *testing.T) {
+	const base, max = 10 * time.Millisecond, time.Second
+	b := &backoff{base: base, max: max}
+
+	// Each delay is random, so check the worst seen over many tries at
+	// each attempt.
+	const tries = 200
+	bound := base
+	var lastWorst time.Duration
+	for attempt := 0; attempt < 10; attempt++ {
+		var worst time.Duration
+		for i := 0; i < tries; i++ {
+			b.attempt = uint(attempt)
+			d := b.next()
+			if d < 0 || bound < d {
+				t.Fatalf("attempt %d: got %s, want within [0, %s]", attempt, d, bound)
+			}
+			if worst < d {
+				worst = d
+			}
+		}
+		if worst < lastWorst/2 {
+			t.Errorf("attempt %d: delays shrank, from up to %s to up to %s", attempt, lastWorst, worst)
+		}
+		// With this many tries, the worst should come near the
+		// bound.
+		if worst < bound/2 {
+			t.Errorf("attempt %d: delays only reached %s of up to %s", attempt, worst, bound)
+		}
+		lastWorst = worst
+		if bound *= 2; max < bound {
+			bound = max
+		}
+	}
+}
+
+// TestBackoffGrows checks that repeated failures, without resets, push the
+// delay up to the cap, and a reset brings it back down.
+func TestBackoffGrows(t *testing.T) {
+	b := &backoff{base: time.Millisecond, max: time.Minute}
+	for i := 0; i < 100; i++ {
+		if d := b.next(); d < 0 || time.Minute < d {
+			t.Fatalf("failure %d: got %s, want within [0, 1m]", i, d)
+		}
+	}
+	if got, want := b.base<<b.attempt, time.Minute; got < want {
+		t.Errorf("after 100 failures, delays are bounded by %s, want the cap of %s", got, want)
+	}
+	b.reset()
+	if d := b.next(); time.Millisecond < d {
+		t.Errorf("after a reset, got %s, want at most the base", d)
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import "encoding/json"
+
+// batchFrame combines payloads, sent within one batch window, into a single
+// frame: a JSON array of them, in order.
+// JSON payloads appear as they are; raw Bifrost lines appear as strings.
+func batchFrame(payloads [][]byte) ([]byte, error) {
+	elems := make([]interface{}, len(payloads))
+	for i, p := range payloads {
+		if json.Valid(p) {
+			elems[i] = json.RawMessage(p)
+		} else {
+			elems[i] = string(p)
+		}
+	}
+	return json.Marshal(elems)
+}
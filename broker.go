@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// brokerWriteWait is how long writing to a message broker may take before
+// the connection is given up on.
+const brokerWriteWait = 10 * time.Second
+
+// brokerMessage is a packed message, and the subject or channel to publish it
+// to.
+type brokerMessage struct {
+	topic   string
+	payload []byte
+}
+
+// brokerProtocol is the part of a brokerSink that speaks a particular
+// message broker's protocol.
+type brokerProtocol interface {
+	// topic returns the subject or channel to publish m to.
+	topic(m serverMessage) string
+	// handshake sets up c, which has just connected, reading anything the
+	// broker sends first from r.
+	handshake(c *brokerConn, r *bufio.Reader) error
+	// publish writes msg to w.
+	publish(w *bufio.Writer, msg brokerMessage) error
+	// reply handles line, read from the broker with its line ending
+	// stripped, returning an error if the connection should be dropped.
+	reply(c *brokerConn, line string) error
+}
+
+// brokerSink is a Sink publishing messages to a message broker, such as NATS,
+// as JSON envelopes.
+//
+// Publishing only queues the message: the sink's own goroutine writes it out,
+// connecting to the broker, and reconnecting as need be, independently of
+// the servers, so that a slow or missing broker never holds up main's loop.
+// Once the queue is full, messages are dropped (and counted) instead.
+type brokerSink struct {
+	// name names the broker, as in "nats", in logs and metrics.
+	name  string
+	addr  string
+	proto brokerProtocol
+
+	queue chan brokerMessage
+	// dropped is the number of messages dropped for the queue being full.
+	// /metrics reads it, so it must be accessed atomically.
+	dropped uint64
+	// dropping is true while messages are being dropped.  Only the caller
+	// of Publish touches it.
+	dropping bool
+
+	backoff *backoff
+	wg      *sync.WaitGroup
+	logger  *leveledLogger
+}
+
+// newBrokerSink creates a sink publishing to the broker at addr, speaking
+// proto, with room to queue size messages, and starts it.  It runs until ctx
+// is cancelled.
+func newBrokerSink(ctx context.Context, name, addr string, proto brokerProtocol, size int, rc reconnectConfig, wg *sync.WaitGroup, logger *leveledLogger) *brokerSink {
+	s := &brokerSink{
+		name:    name,
+		addr:    addr,
+		proto:   proto,
+		queue:   make(chan brokerMessage, size),
+		backoff: &backoff{base: rc.Base.Duration, max: rc.Max.Duration},
+		wg:      wg,
+		logger:  logger,
+	}
+	wg.Add(1)
+	go s.run(ctx)
+	return s
+}
+
+// brokerPackOptions are how messages are packed for brokers: as JSON
+// envelopes, whatever clients get.
+var brokerPackOptions = packOptions{format: formatJSON, timestamps: true}
+
+// Publish queues m for the broker, as a Sink, dropping it if the queue is
+// full.
+func (s *brokerSink) Publish(m serverMessage) error {
+	payload, err := m.pack(brokerPackOptions)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.queue <- brokerMessage{topic: s.proto.topic(m), payload: payload}:
+		if s.dropping {
+			s.logger.Infof("%s: caught up (%d dropped so far)\n", s.name, atomic.LoadUint64(&s.dropped))
+		}
+		s.dropping = false
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		if !s.dropping {
+			s.logger.Warnf("%s: falling behind, dropping messages\n", s.name)
+		}
+		s.dropping = true
+	}
+	return nil
+}
+
+// run connects to the broker, and publishes queued messages until the
+// connection fails, repeating until ctx is cancelled.
+func (s *brokerSink) run(ctx context.Context) {
+	defer s.wg.Done()
+
+	for {
+		err := s.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Warnf("%s: %s\n", s.name, err)
+
+		timer := time.NewTimer(s.backoff.next())
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// serve connects to the broker, and publishes queued messages to it, until
+// the connection fails or ctx is cancelled.
+func (s *brokerSink) serve(ctx context.Context) error {
+	d := net.Dialer{Timeout: defaultConnectTimeout, KeepAlive: defaultKeepAlive}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	c := &brokerConn{conn: conn, w: bufio.NewWriter(conn)}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			s.logger.Debugf("%s: closing connection: %s\n", s.name, err)
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	if err := conn.SetReadDeadline(time.Now().Add(defaultConnectTimeout)); err != nil {
+		return err
+	}
+	if err := s.proto.handshake(c, r); err != nil {
+		return err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	s.backoff.reset()
+	s.logger.Infof("%s: connected to %s\n", s.name, s.addr)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.readLoop(c, r)
+	}()
+
+	for {
+		select {
+		case msg := <-s.queue:
+			if err := c.write(func(w *bufio.Writer) error {
+				return s.proto.publish(w, msg)
+			}); err != nil {
+				return err
+			}
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// errBrokerClosed is the error a broker hanging up leaves.
+var errBrokerClosed = errors.New("broker closed the connection")
+
+// readLoop passes each line the broker sends to the protocol, until reading
+// fails or the protocol gives up on the connection.
+func (s *brokerSink) readLoop(c *brokerConn, r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if line == "" && err == io.EOF {
+				return errBrokerClosed
+			}
+			return err
+		}
+		if err := s.proto.reply(c, strings.TrimRight(line, "\r\n")); err != nil {
+			return err
+		}
+	}
+}
+
+// brokerConn is a connection to a message broker, which both the sink and its
+// read loop write to.
+type brokerConn struct {
+	conn net.Conn
+
+	// w buffers writes to conn, and is guarded by wLock.
+	w     *bufio.Writer
+	wLock sync.Mutex
+}
+
+// write calls f to write to the connection, then flushes what it wrote, all
+// within brokerWriteWait.
+func (c *brokerConn) write(f func(w *bufio.Writer) error) error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(brokerWriteWait)); err != nil {
+		return err
+	}
+	if err := f(c.w); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// validTopicPrefix returns whether prefix is a non-empty run of parts, each
+// safe as it is by topicToken, separated by sep.
+func validTopicPrefix(prefix, sep string) bool {
+	if prefix == "" {
+		return false
+	}
+	for _, part := range strings.Split(prefix, sep) {
+		if part == "" || topicToken(part) != part {
+			return false
+		}
+	}
+	return true
+}
+
+// topicToken makes s safe to use as one part of a subject or channel name,
+// replacing anything brokers treat specially, such as separators, wildcards
+// and whitespace, with "_".
+func topicToken(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ':', '?', '[', ']':
+			return '_'
+		}
+		if r <= ' ' {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// stateCache remembers the latest state messages from each server, so that
+// clients connecting mid-stream can be brought up to date.
+//
+// It is updated by the main loop and read by the pool and HTTP handlers, so
+// is guarded by a lock.
+type stateCache struct {
+	// words lists the message words worth caching, in the order they
+	// are replayed.
+	words []string
+	// ttl, if positive, is how long a cached message stays fresh.
+	ttl time.Duration
+
+	lock    sync.RWMutex
+	servers map[string]*serverState
+}
+
+// cachedMessage is a message in a stateCache, with when it arrived.
+type cachedMessage struct {
+	msg serverMessage
+	at  time.Time
+}
+
+// serverState is the cached state of one server.
+type serverState struct {
+	// event is the latest synthetic event (such as evConnected) for the
+	// server.
+	event *cachedMessage
+	// messages maps message words to the latest message with that word.
+	messages map[string]cachedMessage
+}
+
+// newStateCache creates a stateCache remembering messages with the given
+// words, for up to ttl (or forever, if ttl isn't positive).
+func newStateCache(words []string, ttl time.Duration) *stateCache {
+	return &stateCache{
+		words:   words,
+		ttl:     ttl,
+		servers: make(map[string]*serverState),
+	}
+}
+
+// caches returns whether the cache is interested in messages with word.
+func (sc *stateCache) caches(word string) bool {
+	for _, w := range sc.words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// update records m in the cache, if it is interesting.
+func (sc *stateCache) update(m serverMessage) {
+	word := ""
+	if m.event == "" {
+		word = m.msg.Word().String()
+		if !sc.caches(word) {
+			return
+		}
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	ss, ok := sc.servers[m.server]
+	if !ok {
+		ss = &serverState{messages: make(map[string]cachedMessage)}
+		sc.servers[m.server] = ss
+	}
+
+	cm := cachedMessage{msg: m, at: time.Now()}
+	if m.event == "" {
+		ss.messages[word] = cm
+		return
+	}
+
+	ss.event = &cm
+	// Whatever the server told us before it disconnected is stale.
+	if m.event == evDisconnected {
+		ss.messages = make(map[string]cachedMessage)
+	}
+}
+
+// forget removes everything cached about server.
+func (sc *stateCache) forget(server string) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	delete(sc.servers, server)
+}
+
+// fresh returns whether cm is still fresh at now.
+func (sc *stateCache) fresh(cm cachedMessage, now time.Time) bool {
+	return sc.ttl <= 0 || now.Sub(cm.at) < sc.ttl
+}
+
+// snapshot returns the fresh cached messages for server, event first and then
+// messages in the order of sc.words.
+func (sc *stateCache) snapshot(server string) []serverMessage {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	return sc.snapshotLocked(server, time.Now())
+}
+
+func (sc *stateCache) snapshotLocked(server string, now time.Time) (msgs []serverMessage) {
+	ss, ok := sc.servers[server]
+	if !ok {
+		return
+	}
+
+	if ss.event != nil && sc.fresh(*ss.event, now) {
+		msgs = append(msgs, ss.event.msg)
+	}
+	for _, word := range sc.words {
+		if cm, ok := ss.messages[word]; ok && sc.fresh(cm, now) {
+			msgs = append(msgs, cm.msg)
+		}
+	}
+	return
+}
+
+// snapshotAll returns the snapshots of every server, in order of name.
+func (sc *stateCache) snapshotAll() (msgs []serverMessage) {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+
+	names := make([]string, 0, len(sc.servers))
+	for name := range sc.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	for _, name := range names {
+		msgs = append(msgs, sc.snapshotLocked(name, now)...)
+	}
+	return
+}
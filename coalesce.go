@@ -0,0 +1,99 @@
+package main
+
+import "time"
+
+// coalesceKey identifies a stream of messages being coalesced: those with one
+// word from one server.
+type coalesceKey struct {
+	server, word string
+}
+
+// coalescer thins out streams of frequent messages, such as POSITION, so that
+// only the latest message from each stream is forwarded, at most once per
+// interval.
+//
+// A nil *coalescer forwards everything.  coalescers are used only from the
+// main loop, so aren't safe for concurrent use, except that the timers
+// they set send keys on flushCh.
+type coalescer struct {
+	words    map[string]bool
+	interval time.Duration
+
+	// last is when each stream last forwarded a message.
+	last map[coalesceKey]time.Time
+	// pending holds the latest message from each stream that is being
+	// held back.
+	pending map[coalesceKey]serverMessage
+
+	// flushCh receives the key of each stream whose pending message is
+	// due to be forwarded via flush.
+	flushCh chan coalesceKey
+}
+
+// newCoalescer creates a coalescer for messages with the given words, or nil
+// if there are no words or interval isn't positive (disabling coalescing).
+func newCoalescer(words []string, interval time.Duration) *coalescer {
+	if len(words) == 0 || interval <= 0 {
+		return nil
+	}
+
+	co := &coalescer{
+		words:    make(map[string]bool),
+		interval: interval,
+		last:     make(map[coalesceKey]time.Time),
+		pending:  make(map[coalesceKey]serverMessage),
+		flushCh:  make(chan coalesceKey),
+	}
+	for _, w := range words {
+		co.words[w] = true
+	}
+	return co
+}
+
+// flushes returns the channel of keys to flush, or nil (which never
+// receives) if co is nil.
+func (co *coalescer) flushes() <-chan coalesceKey {
+	if co == nil {
+		return nil
+	}
+	return co.flushCh
+}
+
+// offer returns whether m, arriving at now, should be forwarded now.
+// If not, it is held back, and its key sent on flushCh when it is due.
+func (co *coalescer) offer(m serverMessage, now time.Time) bool {
+	if co == nil || m.event != "" {
+		return true
+	}
+	word := m.msg.Word().String()
+	if !co.words[word] {
+		return true
+	}
+
+	key := coalesceKey{server: m.server, word: word}
+	wait := co.interval - now.Sub(co.last[key])
+	if wait <= 0 {
+		co.last[key] = now
+		return true
+	}
+
+	// Only the first message held back needs a timer; later ones just
+	// replace it.
+	if _, ok := co.pending[key]; !ok {
+		time.AfterFunc(wait, func() {
+			co.flushCh <- key
+		})
+	}
+	co.pending[key] = m
+	return false
+}
+
+// flush returns the message held back for key, if any, recording that it was
+// forwarded at now.
+func (co *coalescer) flush(key coalesceKey, now time.Time) (m serverMessage, ok bool) {
+	if m, ok = co.pending[key]; ok {
+		delete(co.pending, key)
+		co.last[key] = now
+	}
+	return
+}
@@ -0,0 +1,1172 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/UniversityRadioYork/baps3-go"
+	"github.com/gorilla/websocket"
+)
+
+type server struct {
+	// Hostport is the host:port of the server, or, for servers listening
+	// on a Unix socket, a unix:///path/to/socket URL.  A
+	// replay:///path/to/file URL, instead, plays back a file written with
+	// RecordFile, as configured by Replay.
+	Hostport string
+
+	// DisplayName and Role are optional labels for clients to show, such
+	// as "Studio 1" and "On Air".  The server is still addressed by its
+	// name.
+	DisplayName string
+	Role        string
+
+	// ReadOnly, if true, stops clients sending commands to the server,
+	// for example because it is a monitor or preview deck.
+	ReadOnly bool
+
+	// Required, if true, makes heimdallr exit with an error if the server
+	// hasn't connected within StartupTimeout of starting.  If
+	// RetryOnStartup is also set to false, heimdallr exits as soon as
+	// the first attempt at connecting fails, rather than retrying until
+	// the timeout.  Servers that aren't required are retried in the
+	// background, however long they take to come up.
+	Required       bool
+	RetryOnStartup *bool
+
+	// ConnectTimeout bounds how long connecting to the server, and then
+	// waiting for it to say OHAI, may take.  It defaults to
+	// defaultConnectTimeout.
+	ConnectTimeout duration
+
+	// KeepAlive is the period of TCP keepalive probes on the connection
+	// to the server, so that one left half-open (say, by a NAT dropping
+	// it) is noticed and redialled.  It defaults to defaultKeepAlive; a
+	// negative period turns keepalives off.
+	KeepAlive duration
+
+	// MaxLineLength is the longest line, in bytes, heimdallr reads from
+	// the server before giving up on the connection as broken, so a
+	// server that never sends a newline can't make it buffer without
+	// bound.  It defaults to defaultMaxLineLength.
+	MaxLineLength int
+
+	// CommandBuffer is how many commands from clients may queue up for
+	// the server, defaulting to defaultCommandBuffer; CommandPolicy says
+	// what happens to a command arriving once the queue is full, and is
+	// one of the command policies below (by default, commandDropNewest).
+	CommandBuffer int
+	CommandPolicy string
+
+	// Dedup, if positive, drops any message identical to the last one
+	// broadcast from the server, if that was less than Dedup ago.
+	Dedup duration
+
+	// Rename maps words sent by the server to the words clients see in
+	// their place, for servers speaking a slightly different dialect.
+	// Snapshot and coalesce settings still refer to the server's words.
+	Rename map[string]string
+
+	// Allow, if not empty, lists the only words from the server heimdallr
+	// passes on; Deny lists words it drops, even if allowed.  Both refer
+	// to the server's words, before any renaming, and apply before
+	// anything else sees the message.
+	Allow []string
+	Deny  []string
+
+	// OnConnect lists Bifrost commands, such as `login "user"`, to send
+	// the server, in order, every time heimdallr connects to it.
+	OnConnect []string
+
+	// Replay configures replay:// servers.
+	Replay replayConfig
+
+	// CAFile, if set, makes heimdallr connect to the server over TLS,
+	// trusting only the certificate authorities in CAFile.  CertFile and
+	// KeyFile, if both set, are the client certificate to present.  The
+	// server's certificate must match ServerName, or, if that is empty,
+	// the host in Hostport.
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+
+	// LocalAddr, if set, is the local IP address to connect to the server
+	// from, picking the interface on multi-homed hosts.
+	LocalAddr string
+}
+
+// localAddr returns the address to dial s from, or nil to let the system
+// choose.  s.LocalAddr has already been validated.
+func (s server) localAddr() net.Addr {
+	if s.LocalAddr == "" {
+		return nil
+	}
+	return &net.TCPAddr{IP: net.ParseIP(s.LocalAddr)}
+}
+
+// useTLS returns whether the server config asks for TLS.
+func (s server) useTLS() bool {
+	return s.CAFile != ""
+}
+
+// tlsConfig loads the TLS config for connecting to the server.
+// The files are read on every connection, so renewed certificates are picked
+// up without a restart.
+func (s server) tlsConfig() (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(s.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", s.CAFile)
+	}
+
+	conf := &tls.Config{RootCAs: pool, ServerName: s.ServerName}
+	if s.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// defaultConnectTimeout is the default server.ConnectTimeout.
+const defaultConnectTimeout = 10 * time.Second
+
+// defaultKeepAlive is the default server.KeepAlive.
+const defaultKeepAlive = 30 * time.Second
+
+// keepAlive returns the TCP keepalive period for s, which is negative if
+// keepalives are off.
+func (s server) keepAlive() time.Duration {
+	if s.KeepAlive.Duration == 0 {
+		return defaultKeepAlive
+	}
+	return s.KeepAlive.Duration
+}
+
+// Values of server.CommandPolicy.
+const (
+	// commandDropNewest drops the command that didn't fit.
+	commandDropNewest = "dropnewest"
+	// commandDropOldest drops the oldest queued command to make room.
+	commandDropOldest = "dropoldest"
+	// commandReject drops the command that didn't fit, and tells the
+	// client that sent it.
+	commandReject = "reject"
+)
+
+// defaultCommandBuffer is the default server.CommandBuffer.
+const defaultCommandBuffer = 16
+
+// commandBuffer returns s.CommandBuffer, or the default if it isn't set.
+func (s server) commandBuffer() int {
+	if s.CommandBuffer == 0 {
+		return defaultCommandBuffer
+	}
+	return s.CommandBuffer
+}
+
+// commandPolicy returns s.CommandPolicy, or the default if it isn't set.
+func (s server) commandPolicy() string {
+	if s.CommandPolicy == "" {
+		return commandDropNewest
+	}
+	return s.CommandPolicy
+}
+
+// defaultMaxLineLength is the default server.MaxLineLength.
+const defaultMaxLineLength = 64 * 1024
+
+// maxLineLength returns s.MaxLineLength, or the default if it isn't set.
+func (s server) maxLineLength() int {
+	if s.MaxLineLength == 0 {
+		return defaultMaxLineLength
+	}
+	return s.MaxLineLength
+}
+
+// onConnectMessages parses s.OnConnect, which has already been validated, into
+// messages.
+func (s server) onConnectMessages() (msgs []baps3.Message) {
+	for _, line := range s.OnConnect {
+		if msg, err := parseCommand(line); err == nil {
+			msgs = append(msgs, *msg)
+		}
+	}
+	return
+}
+
+// retryOnStartup returns whether s, if required, is retried until the
+// startup timeout, rather than failing startup on its first failed attempt.
+func (s server) retryOnStartup() bool {
+	return s.RetryOnStartup == nil || *s.RetryOnStartup
+}
+
+// connectTimeout returns the connect timeout for s.
+// Servers are decoded into a map, so can't be given defaults up front.
+func (s server) connectTimeout() time.Duration {
+	if s.ConnectTimeout.Duration == 0 {
+		return defaultConnectTimeout
+	}
+	return s.ConnectTimeout.Duration
+}
+
+// Groups of HTTP routes, as in listener.Routes.
+const (
+	// routeWS is the websocket feed, /ws, and its plain HTTP
+	// equivalent, /stream.
+	routeWS = "ws"
+	// routeHealth is the health check, /healthz, /version and /metrics.
+	routeHealth = "health"
+	// routeREST is the REST API: /servers and below, and the per-server
+	// resources.
+	routeREST = "rest"
+	// routeStatic is the static files, including the web UI.
+	routeStatic = "static"
+	// routeAdmin is the admin API, /admin and below, which always needs
+	// the auth token, and so is closed if none is set.
+	routeAdmin = "admin"
+)
+
+// allRoutes lists every group of HTTP routes.
+var allRoutes = []string{routeWS, routeHealth, routeREST, routeStatic, routeAdmin}
+
+// listener is the configuration of one HTTP listener.
+type listener struct {
+	Hostport string
+
+	// CertFile and KeyFile, if both set, make the listener use TLS
+	// (and, consequently, websockets run over wss://).
+	CertFile string
+	KeyFile  string
+
+	// Routes lists the groups of routes (routeWS, etc.) the listener
+	// serves.  If empty, it serves all of them.
+	Routes []string
+}
+
+// useTLS returns whether the listener config asks for TLS.
+func (l listener) useTLS() bool {
+	return l.CertFile != "" && l.KeyFile != ""
+}
+
+// serves returns whether the listener serves the given group of routes.
+func (l listener) serves(route string) bool {
+	if len(l.Routes) == 0 {
+		return true
+	}
+	for _, r := range l.Routes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+type httpServer struct {
+	// Hostport, CertFile and KeyFile configure the single listener used
+	// if Listeners is empty, which serves every route.
+	Hostport string
+	CertFile string
+	KeyFile  string
+
+	// Listeners, if not empty, maps names to the listeners to start, in
+	// place of the single listener above.  All other settings here are
+	// shared between listeners.
+	Listeners map[string]listener
+
+	// PathPrefix, if not empty, is prepended to the path of every route,
+	// for when heimdallr is reverse-proxied under a subpath; for example,
+	// "/radio" serves the websocket feed at /radio/ws.
+	PathPrefix string
+
+	// RawBroadcast, if true, sends clients bare messages instead of JSON
+	// envelopes tagged with the originating server.
+	RawBroadcast bool
+	// Format is the format of each message sent to clients: formatRaw
+	// for Bifrost lines, or formatJSON for JSON objects.
+	Format string
+	// ServerSeparator, if not empty, prefixes each bare raw message with
+	// the name of the server it came from, then ServerSeparator: a
+	// lighter way than envelopes to tell servers apart.
+	ServerSeparator string
+	// Timestamps, if true, as it is by default, includes when heimdallr
+	// received each message, as "received", in JSON envelopes and bare
+	// JSON messages, so clients can measure latency.
+	Timestamps bool
+
+	// HealthRequire is healthAll if /healthz should only report healthy
+	// when every server is connected, or healthAny if one is enough.
+	HealthRequire string
+
+	// SendBuffer is how many messages may be queued for each websocket
+	// client.  A client whose queue is full misses messages, and is
+	// disconnected after missing more than MaxDrops in a row, or after
+	// its queue has been full for DropGrace (if set).
+	SendBuffer int
+	MaxDrops   int
+	DropGrace  duration
+
+	// AllowedOrigins lists the origins from which browsers may open
+	// websockets.  Each is either an exact origin, such as
+	// "https://ury.org.uk", or a pattern with one "*" wildcard, such as
+	// "https://*.ury.org.uk" or just "*".  An empty list allows only
+	// same-origin requests.
+	AllowedOrigins []string
+
+	// CORSOrigins lists, in the same way as AllowedOrigins, the origins on
+	// which browsers may use the HTTP API, with the methods in CORSMethods
+	// and the request headers in CORSHeaders.  If empty, no CORS headers
+	// are sent.  It doesn't affect websockets.
+	CORSOrigins []string
+	CORSMethods []string
+	CORSHeaders []string
+
+	// AuthToken, if set, must be presented (as a bearer token, or in the
+	// token query parameter) to send commands to servers, and to use the
+	// admin API, which is closed if it isn't set.  If RequireAuthForRead
+	// is also set, it must be presented to read from servers too.
+	AuthToken          string
+	RequireAuthForRead bool
+
+	// CommandRate is how many commands per second, on average, each
+	// websocket client may send, with bursts of up to CommandBurst.
+	// Commands over the limit are rejected.  A zero rate disables the
+	// limit.
+	CommandRate  float64
+	CommandBurst int
+	// MaxInFlight, if positive, is the most commands each websocket
+	// client may have sent and not yet had a response to.  Commands over
+	// the limit are rejected until some responses arrive.
+	MaxInFlight int
+
+	// MaxConnections, if positive, is the most websocket clients that may
+	// be connected at once.
+	MaxConnections int
+
+	// WriteWait is the time allowed to write a message to a websocket
+	// client, and PongWait the time allowed for it to answer a ping.
+	// Unlike MaxDrops and DropGrace, which handle a client's queue
+	// filling up, WriteWait handles its socket not taking data at all.
+	// Pings are sent every PingPeriod, which must be less than PongWait.
+	WriteWait  duration
+	PongWait   duration
+	PingPeriod duration
+
+	// Heartbeat, if positive, sends idle websocket clients a
+	// {"event":"ping"} frame after this long without data, for proxies
+	// that close connections carrying only pings.
+	Heartbeat duration
+
+	// BatchWindow, if positive, makes heimdallr collect the messages for
+	// each websocket client for this long before sending them together,
+	// as one JSON array frame, to cut down on frames for busy servers.
+	BatchWindow duration
+
+	// Compression, if true, offers websocket clients permessage-deflate.
+	// This shrinks snapshots and JSON envelopes a lot, at some CPU cost.
+	Compression bool
+
+	// BinaryFrames, if true, sends broadcasts to websocket clients in
+	// binary frames, for consumers that treat them as raw bytes.  JSON is
+	// text, so this needs RawBroadcast with Format formatRaw.
+	BinaryFrames bool
+
+	// DrainTimeout, if positive, is how long heimdallr keeps serving its
+	// existing websocket clients, while refusing new ones, after being
+	// told to shut down.  /stream clients are hung up on straight away.
+	DrainTimeout duration
+
+	// ReadBufferSize and WriteBufferSize are the sizes, in bytes, of the
+	// buffers each websocket connection reads and writes through.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// MaxMessageSize is the largest frame, in bytes, a websocket client
+	// may send.  Clients sending bigger ones are disconnected, with close
+	// code 1009.
+	MaxMessageSize int64
+}
+
+// maxSaneBufferSize is the largest httpServer buffer size not warned about:
+// each connection gets its own buffers, so large ones add up quickly.
+const maxSaneBufferSize = 1 << 20
+
+// pathPrefix returns PathPrefix without any trailing slash.
+func (h httpServer) pathPrefix() string {
+	return strings.TrimSuffix(h.PathPrefix, "/")
+}
+
+// readToken returns the token needed for read-only access, or "" if none is.
+func (h httpServer) readToken() string {
+	if h.RequireAuthForRead {
+		return h.AuthToken
+	}
+	return ""
+}
+
+// frameType returns the websocket message type of broadcasts to clients.
+func (h httpServer) frameType() int {
+	if h.BinaryFrames {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// packOptions returns the options for packing messages sent to clients.
+func (h httpServer) packOptions() packOptions {
+	return packOptions{bare: h.RawBroadcast, format: h.Format, serverSep: h.ServerSeparator, timestamps: h.Timestamps}
+}
+
+// Values of httpServer.HealthRequire.
+const (
+	healthAll = "all"
+	healthAny = "any"
+)
+
+// listeners returns the listeners to start, by name.
+func (h httpServer) listeners() map[string]listener {
+	if len(h.Listeners) != 0 {
+		return h.Listeners
+	}
+	return map[string]listener{
+		"default": {
+			Hostport: h.Hostport,
+			CertFile: h.CertFile,
+			KeyFile:  h.KeyFile,
+		},
+	}
+}
+
+// duration is a time.Duration that can be decoded from TOML strings such as
+// "1s" or "500ms".
+type duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses a duration from text.
+func (d *duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+// reconnectConfig configures how connectors redial lost servers.
+// The delay between attempts starts at Base and doubles up to Max; each
+// actual delay is a random one between zero and that.
+type reconnectConfig struct {
+	Base duration
+	Max  duration
+}
+
+// snapshotConfig configures the state snapshots sent to new clients.
+type snapshotConfig struct {
+	// Words lists the message words whose latest instance from each
+	// server is remembered and replayed, in replay order.
+	Words []string
+	// TTL, if set, is how long a remembered message is replayed for.
+	// Bifrost servers only announce changes, so this is off by default.
+	TTL duration
+}
+
+// historyConfig configures the recent history clients may ask for.
+type historyConfig struct {
+	// Size is how many of the latest messages from each server are
+	// remembered; 0 turns history off.
+	Size int
+}
+
+// natsConfig configures publishing every message to NATS (see brokerSink).
+type natsConfig struct {
+	// URL, if set, is the nats://[user:pass@]host[:port] URL of the NATS
+	// server to publish to.
+	URL string
+	// SubjectPrefix starts the subject of every message, which continues
+	// with the server name and word, as in heimdallr.main.FILE.
+	SubjectPrefix string
+	// Queue is how many messages may wait for NATS, while it is slow or
+	// unreachable, before more are dropped.
+	Queue int
+}
+
+// redisConfig configures publishing every message to Redis pub/sub (see
+// brokerSink).
+type redisConfig struct {
+	// Addr, if set, is the host:port of the Redis server to publish to,
+	// and Password, if set, the password to log in with.
+	Addr     string
+	Password string
+	// ChannelPrefix starts the channel of every message, which continues
+	// with the server name, as in heimdallr:main.
+	ChannelPrefix string
+	// Queue is how many messages may wait for Redis, while it is slow or
+	// unreachable, before more are dropped.
+	Queue int
+}
+
+// coalesceConfig configures the thinning out of frequent messages.
+type coalesceConfig struct {
+	// Words lists the message words, such as POSITION, to coalesce.
+	// Only the latest message with each word from each server is sent
+	// to clients, at most once per Interval.  If Words is empty, or
+	// Interval isn't set, nothing is coalesced.
+	Words    []string
+	Interval duration
+}
+
+// Config is a struct containing the configuration for an instance of Bifrost.
+type Config struct {
+	// LogLevel is the least severe level of message logged: one of
+	// "debug", "info", "warn", or "error".
+	LogLevel string
+
+	// EchoMessages, if true, logs every message received at info level,
+	// rather than debug.
+	EchoMessages bool
+
+	// UpdateBuffer is how many server messages may queue up, waiting to be
+	// broadcast, before connectors have to wait for the broadcaster.
+	UpdateBuffer int
+
+	// RequireInitialConnection, if true, makes heimdallr exit with an
+	// error if no server has connected within StartupTimeout of starting.
+	RequireInitialConnection bool
+	StartupTimeout           duration
+
+	// ShutdownTimeout is how long shutting down may take, once clients
+	// have been drained, before heimdallr gives up and exits anyway.
+	ShutdownTimeout duration
+
+	// RecordFile, if set, is a file to which every message received is
+	// appended (see recorder), for post-mortems.  SIGHUP reopens it.
+	RecordFile string
+	// RecordAllow, if not empty, lists the only words recorded;
+	// RecordDeny lists words not recorded, even if allowed.  Like a
+	// server's Allow and Deny, both refer to the servers' words, before
+	// any renaming.
+	RecordAllow []string
+	RecordDeny  []string
+
+	Servers   map[string]server
+	HTTP      httpServer
+	Reconnect reconnectConfig
+	Snapshot  snapshotConfig
+	Coalesce  coalesceConfig
+	History   historyConfig
+	NATS      natsConfig
+	Redis     redisConfig
+}
+
+// defaultConfig returns the configuration that any config file is decoded
+// over.
+func defaultConfig() Config {
+	return Config{
+		LogLevel:        "info",
+		UpdateBuffer:    64,
+		StartupTimeout:  duration{30 * time.Second},
+		ShutdownTimeout: duration{30 * time.Second},
+		HTTP: httpServer{
+			Format:          formatRaw,
+			Timestamps:      true,
+			HealthRequire:   healthAll,
+			SendBuffer:      256,
+			CORSMethods:     []string{"GET", "POST"},
+			CORSHeaders:     []string{"Authorization", "Content-Type"},
+			MaxDrops:        32,
+			DropGrace:       duration{5 * time.Second},
+			CommandRate:     10,
+			CommandBurst:    10,
+			WriteWait:       duration{10 * time.Second},
+			PongWait:        duration{60 * time.Second},
+			PingPeriod:      duration{54 * time.Second},
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			MaxMessageSize:  4096,
+		},
+		Reconnect: reconnectConfig{
+			Base: duration{time.Second},
+			Max:  duration{time.Minute},
+		},
+		Snapshot: snapshotConfig{
+			Words: []string{"OHAI", "FEATURES", "STATE", "FILE", "TIME"},
+		},
+		NATS: natsConfig{
+			SubjectPrefix: "heimdallr",
+			Queue:         1024,
+		},
+		Redis: redisConfig{
+			ChannelPrefix: "heimdallr",
+			Queue:         1024,
+		},
+	}
+}
+
+// loadConfig reads, decodes, and validates the config files at paths.
+// Values come from, in order of precedence, the environment (see
+// envOverrides), the files (later ones first), and defaultConfig.
+//
+// Each file is decoded over the result of the ones before, so a value set
+// in a later file replaces the earlier one.  Tables, such as [http], merge
+// key by key, but arrays are replaced whole.  Maps, such as [servers],
+// merge entry by entry: a later file can add servers, but a server it
+// mentions is replaced whole, not merged with the earlier one.
+func loadConfig(paths []string) (conf Config, err error) {
+	conf = defaultConfig()
+	for _, path := range paths {
+		conffile, err := readConfigFile(path)
+		if err != nil {
+			return conf, err
+		}
+		if _, err := toml.Decode(string(conffile), &conf); err != nil {
+			if 1 < len(paths) {
+				err = fmt.Errorf("%s: %s", path, err)
+			}
+			return conf, err
+		}
+	}
+	if err = conf.applyEnv(os.LookupEnv); err != nil {
+		return
+	}
+	err = conf.validate()
+	return
+}
+
+// stdinConfigPath is the config path that reads the config from stdin.
+const stdinConfigPath = "-"
+
+// resolveConfigPaths splits arg, the comma-separated list of config files
+// given on the command line, and makes each path absolute, so it still names
+// the same file if heimdallr changes directory.  stdinConfigPath is left
+// alone.
+func resolveConfigPaths(arg string) (paths []string, err error) {
+	for _, path := range strings.Split(arg, ",") {
+		if path == "" {
+			return nil, fmt.Errorf("empty config file path in %q", arg)
+		}
+		if path != stdinConfigPath {
+			if path, err = filepath.Abs(path); err != nil {
+				return nil, err
+			}
+		}
+		paths = append(paths, path)
+	}
+	return
+}
+
+// readsStdin returns whether paths includes stdinConfigPath.
+func readsStdin(paths []string) bool {
+	for _, path := range paths {
+		if path == stdinConfigPath {
+			return true
+		}
+	}
+	return false
+}
+
+// readConfigFile reads the config file at path, or stdin if path is
+// stdinConfigPath, explaining the commonest failures better than the errors
+// from os do.
+func readConfigFile(path string) ([]byte, error) {
+	if path == stdinConfigPath {
+		return ioutil.ReadAll(os.Stdin)
+	}
+
+	conffile, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		return conffile, nil
+	case os.IsNotExist(err):
+		return nil, fmt.Errorf("config file not found at %s", path)
+	case os.IsPermission(err):
+		return nil, fmt.Errorf("no permission to read config file at %s", path)
+	}
+	if fi, serr := os.Stat(path); serr == nil && fi.IsDir() {
+		return nil, fmt.Errorf("config file %s is a directory", path)
+	}
+	return nil, err
+}
+
+// envOverrides maps the environment variables that can override config
+// values to functions applying them.  These are mainly for containerised
+// deployments, and for secrets that shouldn't live in the config file.
+var envOverrides = map[string]func(*Config, string) error{
+	"HEIMDALLR_LOGLEVEL": func(c *Config, v string) error {
+		c.LogLevel = v
+		return nil
+	},
+	"HEIMDALLR_HTTP_HOSTPORT": func(c *Config, v string) error {
+		c.HTTP.Hostport = v
+		return c.HTTP.checkSingleListener()
+	},
+	"HEIMDALLR_HTTP_CERTFILE": func(c *Config, v string) error {
+		c.HTTP.CertFile = v
+		return c.HTTP.checkSingleListener()
+	},
+	"HEIMDALLR_HTTP_KEYFILE": func(c *Config, v string) error {
+		c.HTTP.KeyFile = v
+		return c.HTTP.checkSingleListener()
+	},
+	"HEIMDALLR_HTTP_FORMAT": func(c *Config, v string) error {
+		c.HTTP.Format = v
+		return nil
+	},
+	"HEIMDALLR_HTTP_AUTHTOKEN": func(c *Config, v string) error {
+		c.HTTP.AuthToken = v
+		return nil
+	},
+	"HEIMDALLR_HTTP_MAXCONNECTIONS": func(c *Config, v string) (err error) {
+		c.HTTP.MaxConnections, err = strconv.Atoi(v)
+		return
+	},
+}
+
+// checkSingleListener returns an error if Listeners is set, so that the
+// settings of the single listener, such as Hostport, would be ignored.
+// Overrides of those settings use it so as not to be silently lost.
+func (h httpServer) checkSingleListener() error {
+	if len(h.Listeners) != 0 {
+		return fmt.Errorf("only applies without [http.listeners], which are set")
+	}
+	return nil
+}
+
+// applyEnv overrides config values with any environment variables in
+// envOverrides that lookup finds.
+func (conf *Config) applyEnv(lookup func(string) (string, bool)) error {
+	for _, name := range sortedKeys(envOverrides) {
+		v, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := envOverrides[name](conf, v); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// summariseConfig writes a human-readable summary of conf to w.
+func summariseConfig(w io.Writer, conf Config) {
+	fmt.Fprintln(w, "servers:")
+	for _, name := range sortedKeys(conf.Servers) {
+		s := conf.Servers[name]
+		ro := ""
+		if s.ReadOnly {
+			ro = " (read-only)"
+		}
+		if s.Required {
+			ro += " (required)"
+		}
+		fmt.Fprintf(w, "  %s: %s%s\n", name, s.Hostport, ro)
+	}
+
+	fmt.Fprintln(w, "listeners:")
+	ls := conf.HTTP.listeners()
+	for _, name := range sortedKeys(ls) {
+		l := ls[name]
+		scheme := "http"
+		if l.useTLS() {
+			scheme = "https"
+		}
+		routes := l.Routes
+		if len(routes) == 0 {
+			routes = allRoutes
+		}
+		fmt.Fprintf(w, "  %s: %s://%s (%s)\n", name, scheme, l.Hostport, strings.Join(routes, ", "))
+	}
+}
+
+// requiresServer returns whether any server in conf is required.
+func (conf Config) requiresServer() bool {
+	for _, s := range conf.Servers {
+		if s.Required {
+			return true
+		}
+	}
+	return false
+}
+
+// warnings returns a list of settings in conf that are valid, but probably
+// mistakes.
+func (conf Config) warnings() (warns []string) {
+	if maxSaneBufferSize < conf.HTTP.ReadBufferSize {
+		warns = append(warns, fmt.Sprintf("http: readbuffersize %d is very large, and is allocated per connection", conf.HTTP.ReadBufferSize))
+	}
+	if maxSaneBufferSize < conf.HTTP.WriteBufferSize {
+		warns = append(warns, fmt.Sprintf("http: writebuffersize %d is very large, and is allocated per connection", conf.HTTP.WriteBufferSize))
+	}
+	if conf.HTTP.AuthToken == "" {
+		ls := conf.HTTP.listeners()
+		for _, name := range sortedKeys(ls) {
+			if ls[name].serves(routeAdmin) {
+				warns = append(warns, fmt.Sprintf("http listener %s: authtoken is not set, so the admin API is closed", name))
+			}
+		}
+	}
+	for _, name := range sortedKeys(conf.Servers) {
+		if s := conf.Servers[name]; !s.Required && s.RetryOnStartup != nil {
+			warns = append(warns, fmt.Sprintf("server %s: retryonstartup has no effect unless required is set", name))
+		}
+	}
+	return
+}
+
+// configErrors is the list of every problem found in a config.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "invalid config:\n\t" + strings.Join(e, "\n\t")
+}
+
+// validate checks conf for problems, returning a configErrors listing all of
+// them, or nil if there are none.
+func (conf Config) validate() error {
+	var errs configErrors
+
+	if _, err := parseLogLevel(conf.LogLevel); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if conf.UpdateBuffer < 0 {
+		errs = append(errs, "updatebuffer must not be negative")
+	}
+
+	if (conf.RequireInitialConnection || conf.requiresServer()) && conf.StartupTimeout.Duration <= 0 {
+		errs = append(errs, "startuptimeout must be positive")
+	}
+
+	if conf.ShutdownTimeout.Duration <= 0 {
+		errs = append(errs, "shutdowntimeout must be positive")
+	}
+
+	if len(conf.Servers) == 0 {
+		errs = append(errs, "no servers defined")
+	}
+
+	// Sorting makes the error list, and which of a pair of duplicates is
+	// reported, deterministic.
+	seen := make(map[string]string)
+	for _, name := range sortedKeys(conf.Servers) {
+		if conf.Servers[name].ConnectTimeout.Duration < 0 {
+			errs = append(errs, fmt.Sprintf("server %s: connecttimeout must not be negative", name))
+		}
+		if conf.Servers[name].MaxLineLength < 0 {
+			errs = append(errs, fmt.Sprintf("server %s: maxlinelength must not be negative", name))
+		}
+		if conf.Servers[name].CommandBuffer < 0 {
+			errs = append(errs, fmt.Sprintf("server %s: commandbuffer must not be negative", name))
+		}
+		switch p := conf.Servers[name].commandPolicy(); p {
+		case commandDropNewest, commandDropOldest, commandReject:
+		default:
+			errs = append(errs, fmt.Sprintf("server %s: commandpolicy must be %q, %q or %q, not %q", name, commandDropNewest, commandDropOldest, commandReject, p))
+		}
+		if la := conf.Servers[name].LocalAddr; la != "" {
+			if net.ParseIP(la) == nil {
+				errs = append(errs, fmt.Sprintf("server %s: localaddr %q is not an IP address", name, la))
+			} else if !dialsTCP(conf.Servers[name].Hostport) {
+				errs = append(errs, fmt.Sprintf("server %s: localaddr only applies to TCP servers", name))
+			}
+		}
+		if conf.Servers[name].Dedup.Duration < 0 {
+			errs = append(errs, fmt.Sprintf("server %s: dedup must not be negative", name))
+		}
+		if rc := conf.Servers[name].Replay; rc.Speed < 0 || rc.Rate < 0 {
+			errs = append(errs, fmt.Sprintf("server %s: replay speed and rate must not be negative", name))
+		}
+		if s := conf.Servers[name]; (s.CertFile == "") != (s.KeyFile == "") {
+			errs = append(errs, fmt.Sprintf("server %s: certfile and keyfile must be set together", name))
+		} else if s.CertFile != "" && !s.useTLS() {
+			errs = append(errs, fmt.Sprintf("server %s: certfile needs cafile", name))
+		} else if _, ok := replayPath(s.Hostport); ok && s.useTLS() {
+			errs = append(errs, fmt.Sprintf("server %s: replay servers can't use tls", name))
+		}
+		for _, line := range conf.Servers[name].OnConnect {
+			if _, err := parseCommand(line); err != nil {
+				errs = append(errs, fmt.Sprintf("server %s: bad onconnect command: %s", name, err))
+			}
+		}
+		rename := conf.Servers[name].Rename
+		for _, from := range sortedKeys(rename) {
+			if to := rename[from]; to == "" || strings.ContainsAny(to, " \t\n") {
+				errs = append(errs, fmt.Sprintf("server %s: can't rename %s to %q", name, from, to))
+			}
+		}
+		for _, word := range append(conf.Servers[name].Allow, conf.Servers[name].Deny...) {
+			if word == "" || strings.ContainsAny(word, " \t\n") {
+				errs = append(errs, fmt.Sprintf("server %s: can't filter on word %q", name, word))
+			}
+		}
+		hostport := conf.Servers[name].Hostport
+		if err := checkServerAddr(hostport); err != nil {
+			errs = append(errs, fmt.Sprintf("server %s: %s", name, err))
+			continue
+		}
+		key := canonicalHostport(hostport)
+		if other, ok := seen[key]; ok {
+			errs = append(errs, fmt.Sprintf("server %s: hostport %s already used by server %s", name, hostport, other))
+			continue
+		}
+		seen[key] = name
+	}
+
+	if len(conf.HTTP.Listeners) == 0 && conf.HTTP.Hostport == "" {
+		errs = append(errs, "http: hostport not set")
+	}
+	if conf.HTTP.PathPrefix != "" && !strings.HasPrefix(conf.HTTP.PathPrefix, "/") {
+		errs = append(errs, fmt.Sprintf("http: pathprefix %q must start with /", conf.HTTP.PathPrefix))
+	}
+	ls := conf.HTTP.listeners()
+	lseen := make(map[string]string)
+	for _, name := range sortedKeys(ls) {
+		l := ls[name]
+		if err := checkHostport(l.Hostport, false); err != nil {
+			errs = append(errs, fmt.Sprintf("http listener %s: %s", name, err))
+			continue
+		}
+		key := canonicalHostport(l.Hostport)
+		if other, ok := lseen[key]; ok {
+			errs = append(errs, fmt.Sprintf("http listener %s: hostport %s already used by listener %s", name, l.Hostport, other))
+		}
+		lseen[key] = name
+		for _, route := range l.Routes {
+			if !knownRoute(route) {
+				errs = append(errs, fmt.Sprintf("http listener %s: unknown route %q", name, route))
+			}
+			if route == routeAdmin && conf.HTTP.AuthToken == "" {
+				errs = append(errs, fmt.Sprintf("http listener %s: route %q needs authtoken to be set", name, route))
+			}
+		}
+	}
+
+	if conf.HTTP.Format != formatRaw && conf.HTTP.Format != formatJSON {
+		errs = append(errs, fmt.Sprintf("http: format must be %q or %q", formatRaw, formatJSON))
+	}
+	if conf.HTTP.HealthRequire != healthAll && conf.HTTP.HealthRequire != healthAny {
+		errs = append(errs, fmt.Sprintf("http: healthrequire must be %q or %q", healthAll, healthAny))
+	}
+
+	if conf.HTTP.RequireAuthForRead && conf.HTTP.AuthToken == "" {
+		errs = append(errs, "http: requireauthforread needs authtoken to be set")
+	}
+	if conf.HTTP.SendBuffer <= 0 {
+		errs = append(errs, "http: sendbuffer must be positive")
+	}
+	if conf.HTTP.MaxDrops < 0 {
+		errs = append(errs, "http: maxdrops must not be negative")
+	}
+	if conf.HTTP.DropGrace.Duration < 0 {
+		errs = append(errs, "http: dropgrace must not be negative")
+	}
+
+	if conf.HTTP.WriteWait.Duration <= 0 {
+		errs = append(errs, "http: writewait must be positive")
+	}
+	if conf.HTTP.PingPeriod.Duration <= 0 {
+		errs = append(errs, "http: pingperiod must be positive")
+	}
+	if conf.HTTP.PongWait.Duration <= conf.HTTP.PingPeriod.Duration {
+		errs = append(errs, "http: pingperiod must be less than pongwait")
+	}
+	if conf.HTTP.BinaryFrames && (!conf.HTTP.RawBroadcast || conf.HTTP.Format != formatRaw) {
+		errs = append(errs, "http: binaryframes needs rawbroadcast with format raw")
+	}
+	if conf.HTTP.ServerSeparator != "" && (!conf.HTTP.RawBroadcast || conf.HTTP.Format != formatRaw) {
+		errs = append(errs, "http: serverseparator needs rawbroadcast with format raw")
+	}
+	if conf.HTTP.BatchWindow.Duration < 0 {
+		errs = append(errs, "http: batchwindow must not be negative")
+	}
+	if 0 < conf.HTTP.BatchWindow.Duration && conf.HTTP.BinaryFrames {
+		errs = append(errs, "http: batches are JSON, so can't be sent as binaryframes")
+	}
+	if conf.HTTP.Heartbeat.Duration < 0 {
+		errs = append(errs, "http: heartbeat must not be negative")
+	}
+	if conf.HTTP.DrainTimeout.Duration < 0 {
+		errs = append(errs, "http: draintimeout must not be negative")
+	}
+	if conf.HTTP.ReadBufferSize <= 0 {
+		errs = append(errs, "http: readbuffersize must be positive")
+	}
+	if conf.HTTP.WriteBufferSize <= 0 {
+		errs = append(errs, "http: writebuffersize must be positive")
+	}
+	if conf.HTTP.MaxMessageSize <= 0 {
+		errs = append(errs, "http: maxmessagesize must be positive")
+	}
+	if conf.HTTP.MaxConnections < 0 {
+		errs = append(errs, "http: maxconnections must not be negative")
+	}
+	if conf.HTTP.CommandRate < 0 {
+		errs = append(errs, "http: commandrate must not be negative")
+	}
+	if 0 < conf.HTTP.CommandRate && conf.HTTP.CommandBurst < 1 {
+		errs = append(errs, "http: commandburst must be at least 1")
+	}
+	if conf.HTTP.MaxInFlight < 0 {
+		errs = append(errs, "http: maxinflight must not be negative")
+	}
+
+	if conf.Reconnect.Base.Duration <= 0 {
+		errs = append(errs, "reconnect: base must be positive")
+	}
+	if conf.Reconnect.Max.Duration < conf.Reconnect.Base.Duration {
+		errs = append(errs, "reconnect: max must be at least base")
+	}
+
+	if conf.Coalesce.Interval.Duration < 0 {
+		errs = append(errs, "coalesce: interval must not be negative")
+	}
+
+	if conf.History.Size < 0 {
+		errs = append(errs, "history: size must not be negative")
+	}
+	if conf.NATS.URL != "" {
+		if _, _, _, err := parseNATSURL(conf.NATS.URL); err != nil {
+			errs = append(errs, fmt.Sprintf("nats: url: %s", err))
+		}
+		if !validTopicPrefix(conf.NATS.SubjectPrefix, ".") {
+			errs = append(errs, fmt.Sprintf("nats: subjectprefix %q must be non-empty, without wildcards or spaces", conf.NATS.SubjectPrefix))
+		}
+		if conf.NATS.Queue < 1 {
+			errs = append(errs, "nats: queue must be at least 1")
+		}
+	}
+	if conf.Redis.Addr != "" {
+		if _, _, err := net.SplitHostPort(conf.Redis.Addr); err != nil {
+			errs = append(errs, fmt.Sprintf("redis: addr: %s", err))
+		}
+		if !validTopicPrefix(conf.Redis.ChannelPrefix, ":") {
+			errs = append(errs, fmt.Sprintf("redis: channelprefix %q must be non-empty, without wildcards or spaces", conf.Redis.ChannelPrefix))
+		}
+		if conf.Redis.Queue < 1 {
+			errs = append(errs, "redis: queue must be at least 1")
+		}
+	}
+	if conf.Snapshot.TTL.Duration < 0 {
+		errs = append(errs, "snapshot: ttl must not be negative")
+	}
+
+	if errs == nil {
+		return nil
+	}
+	return errs
+}
+
+// sortedKeys returns the keys of m, which must be a map with string keys, in
+// order.
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.String()
+	}
+	sort.Strings(names)
+	return names
+}
+
+// knownRoute returns whether route names a group of HTTP routes.
+func knownRoute(route string) bool {
+	for _, r := range allRoutes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// checkServerAddr checks that hostport is a valid server.Hostport: either a
+// host:port with a host, or a unix:// or replay:// URL with a path.
+func checkServerAddr(hostport string) error {
+	if path, ok := replayPath(hostport); ok {
+		if path == "" {
+			return fmt.Errorf("hostport %s has no file path", hostport)
+		}
+		return nil
+	}
+	if network, addr := serverNetwork(hostport); network == "unix" {
+		if addr == "" {
+			return fmt.Errorf("hostport %s has no socket path", hostport)
+		}
+		return nil
+	}
+	return checkHostport(hostport, true)
+}
+
+// dialsTCP returns whether hostport, a server.Hostport, is reached over TCP,
+// rather than being a Unix socket or a replay.
+func dialsTCP(hostport string) bool {
+	if _, ok := replayPath(hostport); ok {
+		return false
+	}
+	network, _ := serverNetwork(hostport)
+	return network == "tcp"
+}
+
+// checkHostport checks that hostport is a valid host:port pair.
+// If needHost is false, the host may be empty (meaning all interfaces).
+func checkHostport(hostport string, needHost bool) error {
+	if hostport == "" {
+		return fmt.Errorf("hostport not set")
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		if strings.Count(hostport, ":") > 1 && !strings.HasPrefix(hostport, "[") {
+			return fmt.Errorf("hostport %s looks like an IPv6 address, which must be bracketed, as in [::1]:1350", hostport)
+		}
+		return err
+	}
+	if needHost && host == "" {
+		return fmt.Errorf("hostport %s has no host", hostport)
+	}
+	// Only IPv6 addresses may be bracketed, and SplitHostPort doesn't
+	// check that they are.
+	if strings.HasPrefix(hostport, "[") {
+		if net.ParseIP(stripZone(host)) == nil || !strings.Contains(host, ":") {
+			return fmt.Errorf("hostport %s has invalid IPv6 address %s", hostport, host)
+		}
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("hostport %s has invalid port %s", hostport, port)
+	}
+	return nil
+}
+
+// stripZone removes any zone, as in fe80::1%eth0, from an IPv6 address.
+func stripZone(host string) string {
+	if i := strings.LastIndex(host, "%"); i != -1 {
+		return host[:i]
+	}
+	return host
+}
+
+// canonicalHostport returns hostport with any IP address in its canonical
+// form, so that, say, [::1]:1350 and [0:0::1]:1350 are seen as the same.
+// Anything it can't parse is returned as is.
+func canonicalHostport(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns a config that validates, for tests to break.
+func validConfig() Config {
+	conf := defaultConfig()
+	conf.Servers = map[string]server{
+		"main": {Hostport: "localhost:1350"},
+	}
+	conf.HTTP.Hostport = ":3000"
+	return conf
+}
+
+// TestValidate checks that validate reports each kind of problem, and passes
+// a good config.
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(conf *Config)
+		// want lists substrings of the expected problems, or is empty
+		// if the config should validate.
+		want []string
+	}{
+		{"valid", func(conf *Config) {}, nil},
+		{"no servers", func(conf *Config) {
+			conf.Servers = nil
+		}, []string{"no servers defined"}},
+		{"no http hostport", func(conf *Config) {
+			conf.HTTP.Hostport = ""
+		}, []string{"http: hostport not set"}},
+		{"server with no port", func(conf *Config) {
+			conf.Servers["main"] = server{Hostport: "localhost"}
+		}, []string{"server main: "}},
+		{"server with no host", func(conf *Config) {
+			conf.Servers["main"] = server{Hostport: ":1350"}
+		}, []string{"server main: hostport :1350 has no host"}},
+		{"duplicate servers", func(conf *Config) {
+			conf.Servers["other"] = server{Hostport: "localhost:1350"}
+		}, []string{"server other: hostport localhost:1350 already used by server main"}},
+		{"duplicate servers, spelt differently", func(conf *Config) {
+			conf.Servers["main"] = server{Hostport: "[::1]:1350"}
+			conf.Servers["other"] = server{Hostport: "[0:0::1]:1350"}
+		}, []string{"already used by server main"}},
+		{"unix socket with no path", func(conf *Config) {
+			conf.Servers["main"] = server{Hostport: "unix://"}
+		}, []string{"server main: hostport unix:// has no socket path"}},
+		{"reconnect max below base", func(conf *Config) {
+			conf.Reconnect.Max = duration{time.Millisecond}
+		}, []string{"reconnect: max must be at least base"}},
+		{"bad log level", func(conf *Config) {
+			conf.LogLevel = "loud"
+		}, []string{"unknown log level: loud"}},
+		{"bad format", func(conf *Config) {
+			conf.HTTP.Format = "xml"
+		}, []string{"http: format must be"}},
+		{"read auth without token", func(conf *Config) {
+			conf.HTTP.RequireAuthForRead = true
+		}, []string{"http: requireauthforread needs authtoken to be set"}},
+		{"every problem at once", func(conf *Config) {
+			conf.Servers = nil
+			conf.HTTP.Hostport = ""
+			conf.Reconnect.Base = duration{}
+		}, []string{"no servers defined", "http: hostport not set", "reconnect: base must be positive"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := validConfig()
+			tt.edit(&conf)
+			err := conf.validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("got %s, want no error", err)
+				}
+				return
+			}
+			errs, ok := err.(configErrors)
+			if !ok {
+				t.Fatalf("got %v, want a configErrors", err)
+			}
+			for _, want := range tt.want {
+				if !containsMatch(errs, want) {
+					t.Errorf("no problem mentioning %q in %q", want, errs)
+				}
+			}
+		})
+	}
+}
+
+// containsMatch returns whether any of errs contains want.
+func containsMatch(errs []string, want string) bool {
+	for _, e := range errs {
+		if strings.Contains(e, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestApplyEnv checks that environment variables override the config, and
+// that overriding the single listener fails if listeners are configured.
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"HEIMDALLR_HTTP_HOSTPORT":       "[::]:8080",
+		"HEIMDALLR_HTTP_MAXCONNECTIONS": "12",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	conf := validConfig()
+	if err := conf.applyEnv(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if conf.HTTP.Hostport != "[::]:8080" || conf.HTTP.MaxConnections != 12 {
+		t.Errorf("got hostport %q, maxconnections %d; want the environment's", conf.HTTP.Hostport, conf.HTTP.MaxConnections)
+	}
+	if l := conf.HTTP.listeners()["default"]; l.Hostport != "[::]:8080" {
+		t.Errorf("default listener got hostport %q, want the environment's", l.Hostport)
+	}
+
+	conf = validConfig()
+	conf.HTTP.Listeners = map[string]listener{"public": {Hostport: ":3000"}}
+	err := conf.applyEnv(lookup)
+	if err == nil || !strings.Contains(err.Error(), "HEIMDALLR_HTTP_HOSTPORT") {
+		t.Errorf("got %v, want an error about HEIMDALLR_HTTP_HOSTPORT", err)
+	}
+
+	env = map[string]string{"HEIMDALLR_HTTP_MAXCONNECTIONS": "lots"}
+	conf = validConfig()
+	if err := conf.applyEnv(lookup); err == nil {
+		t.Error("bad maxconnections applied")
+	}
+}
+
+// TestCheckHostport checks that IPv4, bracketed IPv6 and hostname forms are
+// accepted, for servers and listeners, and malformed ones rejected.
+func TestCheckHostport(t *testing.T) {
+	tests := []struct {
+		hostport string
+		needHost bool
+		ok       bool
+	}{
+		{"127.0.0.1:1350", true, true},
+		{"[::1]:1350", true, true},
+		{"[fe80::1%eth0]:1350", true, true},
+		{"bifrost.ury.org.uk:1350", true, true},
+		{"localhost:1350", true, true},
+		{":3000", false, true},
+		{"[::]:3000", false, true},
+		{"0.0.0.0:3000", false, true},
+
+		{"", false, false},
+		{":1350", true, false},
+		{"::1:1350", true, false},
+		{"[127.0.0.1]:1350", true, false},
+		{"[localhost]:1350", true, false},
+		{"localhost", true, false},
+		{"localhost:http", true, false},
+		{"localhost:65536", true, false},
+	}
+	for _, tt := range tests {
+		err := checkHostport(tt.hostport, tt.needHost)
+		if tt.ok && err != nil {
+			t.Errorf("%q: got %s, want it accepted", tt.hostport, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%q: accepted, want an error", tt.hostport)
+		}
+	}
+}
+
+// TestCanonicalHostport checks that differently written forms of the same
+// address are recognised as the same, and others left alone.
+func TestCanonicalHostport(t *testing.T) {
+	tests := []struct{ a, b string }{
+		{"[::1]:1350", "[0:0::1]:1350"},
+		{"[::ffff:127.0.0.1]:1350", "127.0.0.1:1350"},
+		{"127.0.0.1:1350", "127.0.0.1:1350"},
+		{"localhost:1350", "localhost:1350"},
+	}
+	for _, tt := range tests {
+		if a, b := canonicalHostport(tt.a), canonicalHostport(tt.b); a != b {
+			t.Errorf("%q became %q, but %q became %q", tt.a, a, tt.b, b)
+		}
+	}
+	if a, b := canonicalHostport("[::1]:1350"), canonicalHostport("127.0.0.1:1350"); a == b {
+		t.Errorf("IPv6 and IPv4 loopback both became %q", a)
+	}
+}
+
+// TestDialHostportForms checks that upstreams dial servers given by IPv4,
+// bracketed IPv6, and hostname, where the host supports them.
+func TestDialHostportForms(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Logf("%s: can't listen, skipping: %s", addr, err)
+			continue
+		}
+		defer ln.Close()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		hostports := []string{ln.Addr().String()}
+		if addr == "127.0.0.1:0" {
+			hostports = append(hostports, net.JoinHostPort("localhost", port))
+		}
+		for _, hostport := range hostports {
+			if err := checkServerAddr(hostport); err != nil {
+				t.Errorf("%s: %s", hostport, err)
+			}
+			u := &upstream{hostport: hostport, timeout: time.Second}
+			conn, err := u.dial()
+			if err != nil {
+				t.Errorf("dialling %s: %s", hostport, err)
+				continue
+			}
+			conn.Close()
+		}
+	}
+}
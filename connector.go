@@ -1,12 +1,13 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"errors"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/UniversityRadioYork/baps3-go"
 )
@@ -25,68 +26,360 @@ func GetOk(value interface{}) *GetResponse {
 	return r
 }
 
+// connectorStatus is a snapshot of the health of a connector.
+type connectorStatus struct {
+	// Connected is true while the upstream connection is up.
+	Connected bool `json:"connected"`
+
+	// LastError describes the last error that kept or took the upstream
+	// connection down, at LastErrorAt, or is "" if there has been none.
+	// It is kept after reconnecting, as a clue to what happened.
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+
+	// everConnected is true if the upstream connection has ever been up.
+	everConnected bool
+}
+
 type bfConnector struct {
-	conn   *baps3.Connector
+	conn   *upstream
 	name   string
 	wg     *sync.WaitGroup
-	logger *log.Logger
+	logger *leveledLogger
 	state  *baps3.ServiceState
 
-	reqCh chan httpRequest
-	resCh <-chan baps3.Message
+	// readOnly is true if clients may not send commands to the server.
+	readOnly bool
+
+	// displayName and role label the server for clients.
+	displayName, role string
+
+	// dedup, if positive, is how long after broadcasting a message an
+	// identical one is dropped; last is the last message broadcast, at
+	// lastAt.  Only Run touches last and lastAt.
+	dedup  time.Duration
+	last   string
+	lastAt time.Time
+
+	// rename maps words from the server to the words clients see instead.
+	rename map[string]string
+
+	// allow, if not nil, is the set of the only words from the server
+	// passed on, and deny the set of words dropped regardless.
+	allow, deny map[string]bool
+
+	// status is read by HTTP handlers as well as the connector itself,
+	// so is guarded by statusLock.
+	status     connectorStatus
+	statusLock sync.RWMutex
+
+	// stats counts messages from the server; it has its own lock.
+	stats connectorStats
+
+	reqCh    chan httpRequest
+	resCh    <-chan upstreamMessage
+	statusCh <-chan bool
+
+	// cancel cancels the context the connector runs under, shutting it
+	// down; done is that context's Done channel, for anything waiting on
+	// the connector to give up once it has.
+	cancel context.CancelFunc
+	done   <-chan struct{}
+
+	// commandPolicy says what command does when the upstream's queue of
+	// commands is full (see server.CommandPolicy).
+	commandPolicy string
 
 	// TODO(CaptainHayashi): move this away from baps3.Message to
 	// something generic.
-	updateCh chan<- baps3.Message
+	updateCh chan<- serverMessage
 }
 
-func initBfConnector(name string, updateCh chan<- baps3.Message, wg *sync.WaitGroup, logger *log.Logger) (c *bfConnector) {
-	resCh := make(chan baps3.Message)
+func initBfConnector(name string, s server, rc reconnectConfig, updateCh chan<- serverMessage, wg *sync.WaitGroup, logger *leveledLogger) (c *bfConnector) {
+	resCh := make(chan upstreamMessage)
+	statusCh := make(chan bool)
 
 	c = new(bfConnector)
 	c.resCh = resCh
-	c.conn = baps3.InitConnector(name, resCh, wg, logger)
+	c.statusCh = statusCh
+	c.conn = &upstream{
+		name:        name,
+		hostport:    s.Hostport,
+		backoff:     &backoff{base: rc.Base.Duration, max: rc.Max.Duration},
+		timeout:     s.connectTimeout(),
+		maxLine:     s.maxLineLength(),
+		localAddr:   s.localAddr(),
+		keepAlive:   s.keepAlive(),
+		hello:       s.onConnectMessages(),
+		replay:      s.Replay,
+		ReqCh:       make(chan command, s.commandBuffer()),
+		reconnectCh: make(chan struct{}, 1),
+		noteError:   c.setLastError,
+		resCh:       resCh,
+		statusCh:    statusCh,
+		wg:          wg,
+		logger:      logger,
+	}
+	if s.useTLS() {
+		c.conn.tlsConfig = s.tlsConfig
+	}
 	c.name = name
+	c.readOnly = s.ReadOnly
+	c.displayName = s.DisplayName
+	c.role = s.Role
+	c.dedup = s.Dedup.Duration
+	c.rename = s.Rename
+	if len(s.Allow) != 0 {
+		c.allow = wordSet(s.Allow)
+	}
+	c.deny = wordSet(s.Deny)
 	c.wg = wg
 	c.logger = logger
 	c.reqCh = make(chan httpRequest)
+	c.commandPolicy = s.commandPolicy()
 	c.updateCh = updateCh
 	c.state = baps3.InitServiceState()
 	return
 }
 
-func (c *bfConnector) Run() {
+// Run runs the connector, and its upstream connection, until ctx is
+// cancelled.
+func (c *bfConnector) Run(ctx context.Context) {
 	defer c.wg.Done()
-	defer close(c.conn.ReqCh)
 
-	go c.conn.Run()
+	go c.conn.Run(ctx)
 
-	fmt.Printf("connector %s now listening for requests\n", c.name)
+	c.logger.Infof("connector %s now listening for requests\n", c.name)
 
 	for {
 		select {
-		case rq, ok := <-c.reqCh:
-			if !ok {
-				return
-			}
-
+		case <-ctx.Done():
+			return
+		case rq := <-c.reqCh:
 			// TODO(CaptainHayashi): probably make this more robust
 			resource := strings.Replace(rq.resource, "/"+c.name, "", 1)
-			fmt.Printf("connector %s response %s\n", c.name, resource)
+			c.logger.Debugf("connector %s response %s\n", c.name, resource)
 
 			// TODO(CaptainHayashi): other methods
 			rq.resCh <- c.get(resource)
-		case res := <-c.resCh:
+		case connected := <-c.statusCh:
+			c.setConnected(connected)
+		case um := <-c.resCh:
+			res, now := um.msg, um.at
+			c.stats.record(now)
+			if !c.permitted(res) {
+				c.stats.deny()
+				c.logger.Debugf("connector %s: dropping denied %s\n", c.name, res.String())
+				break
+			}
 			if err := c.state.Update(res); err != nil {
-				fmt.Println(err)
+				c.logger.Warnf("connector %s: %s\n", c.name, err)
+			}
+			if c.duplicate(res, now) {
+				c.logger.Debugf("connector %s: dropping duplicate %s\n", c.name, res.String())
+				break
 			}
-			c.updateCh <- res
+			c.sendUpdate(c.mapMessage(res, now))
+		}
+	}
+}
+
+// errCommandQueueFull is returned by command when the reject policy turns a
+// command away.
+var errCommandQueueFull = errors.New("command queue full")
+
+// command queues msg, from a client, to send to the server, without blocking,
+// so a slow server can't hold up clients.
+// If ack is not nil, it is called with the server's response, or with nil
+// if none is coming (see upstream.acknowledge).
+// If the queue is full, the command policy decides what to drop; under
+// commandReject, command returns errCommandQueueFull, and ack is never
+// called.
+func (c *bfConnector) command(msg baps3.Message, ack func(res *baps3.Message)) error {
+	c.logger.Debugf("connector %s command %s\n", c.name, msg.String())
+	rq := command{msg: msg, ack: ack}
+	select {
+	case c.conn.ReqCh <- rq:
+		return nil
+	default:
+	}
+
+	n := c.stats.dropCommand()
+	switch c.commandPolicy {
+	case commandDropOldest:
+		select {
+		case old := <-c.conn.ReqCh:
+			c.logger.Warnf("connector %s: command queue full, dropping oldest %s (%d dropped so far)\n", c.name, old.msg.String(), n)
+			old.lost()
+		default:
+		}
+		select {
+		case c.conn.ReqCh <- rq:
+		default:
+			// Someone else took the room; drop this one after all.
+			c.logger.Warnf("connector %s: command queue full, dropping %s\n", c.name, msg.String())
+			rq.lost()
 		}
+		return nil
+	case commandReject:
+		c.logger.Warnf("connector %s: command queue full, rejecting %s (%d dropped so far)\n", c.name, msg.String(), n)
+		return errCommandQueueFull
+	default:
+		c.logger.Warnf("connector %s: command queue full, dropping %s (%d dropped so far)\n", c.name, msg.String(), n)
+		rq.lost()
+		return nil
 	}
+}
+
+// permitted returns whether the server's allow and deny lists let msg through.
+// Deny takes precedence over allow.
+func (c *bfConnector) permitted(msg baps3.Message) bool {
+	return wordPermitted(msg.Word().String(), c.allow, c.deny)
+}
 
+// duplicate returns whether msg, received at now, should be dropped as a
+// repeat of the last message broadcast; if not, it becomes that message.
+func (c *bfConnector) duplicate(msg baps3.Message, now time.Time) bool {
+	if c.dedup <= 0 {
+		return false
+	}
+	line := msg.String()
+	if line == c.last && now.Sub(c.lastAt) < c.dedup {
+		return true
+	}
+	c.last, c.lastAt = line, now
+	return false
+}
+
+// mapMessage wraps msg, from the server and read at at, in a serverMessage,
+// renaming its word if the server's config asks for that.  Other words pass
+// through untouched.
+func (c *bfConnector) mapMessage(msg baps3.Message, at time.Time) serverMessage {
+	return serverMessage{
+		server:   c.name,
+		msg:      msg,
+		alias:    c.rename[msg.Word().String()],
+		received: at,
+	}
+}
+
+// sendUpdate sends m on the update channel.
+// If the channel is full, heimdallr is falling behind its servers; sendUpdate
+// then counts and logs the stall before waiting for room, unless the
+// connector shuts down first.
+func (c *bfConnector) sendUpdate(m serverMessage) {
+	select {
+	case c.updateCh <- m:
+		return
+	default:
+	}
+	n := c.stats.stall()
+	c.logger.Warnf("connector %s: update queue full, waiting (%d stalls so far)\n", c.name, n)
+	select {
+	case c.updateCh <- m:
+	case <-c.done:
+	}
+}
+
+// getStatus returns a snapshot of the connector's status.
+func (c *bfConnector) getStatus() connectorStatus {
+	c.statusLock.RLock()
+	defer c.statusLock.RUnlock()
+	return c.status
+}
+
+// stop shuts the connector, and its upstream connection, down.
+// It is safe to call more than once.
+func (c *bfConnector) stop() {
+	c.cancel()
+}
+
+// connectorSet is the set of running connectors, keyed by name.
+// It is safe for concurrent use, as reloading the config changes it while
+// HTTP and websocket clients are looking connectors up.
+type connectorSet struct {
+	lock sync.RWMutex
+	m    map[string]*bfConnector
+}
+
+// newConnectorSet creates an empty connectorSet.
+func newConnectorSet() *connectorSet {
+	return &connectorSet{m: make(map[string]*bfConnector)}
+}
+
+// get looks up the connector called name.
+func (cs *connectorSet) get(name string) (c *bfConnector, ok bool) {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	c, ok = cs.m[name]
 	return
 }
 
+// add adds c to the set, under its name.
+func (cs *connectorSet) add(c *bfConnector) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.m[c.name] = c
+}
+
+// remove removes, and returns, the connector called name, if any.
+func (cs *connectorSet) remove(name string) (c *bfConnector) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	c = cs.m[name]
+	delete(cs.m, name)
+	return
+}
+
+// all returns every connector in the set, sorted by name.
+func (cs *connectorSet) all() []*bfConnector {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	names := make([]string, 0, len(cs.m))
+	for name := range cs.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	connectors := make([]*bfConnector, len(names))
+	for i, name := range names {
+		connectors[i] = cs.m[name]
+	}
+	return connectors
+}
+
+// setConnected records a change in upstream connection status, and tells
+// clients about it.
+func (c *bfConnector) setConnected(connected bool) {
+	c.statusLock.Lock()
+	c.status.Connected = connected
+	c.status.everConnected = c.status.everConnected || connected
+	c.statusLock.Unlock()
+	c.stats.setConnected(connected, time.Now())
+
+	event := evDisconnected
+	if connected {
+		// Anything we knew about the server is now stale.
+		c.state = baps3.InitServiceState()
+		c.last = ""
+		event = evConnected
+	}
+	c.logger.Infof("connector %s %s\n", c.name, event)
+	c.sendUpdate(serverMessage{server: c.name, event: event})
+}
+
+// setLastError records err as the last error of the upstream connection.
+// The upstream calls it from its own goroutine.
+func (c *bfConnector) setLastError(err error) {
+	now := time.Now()
+
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.status.LastError = err.Error()
+	c.status.LastErrorAt = &now
+}
+
 func splitResource(resource string) []string {
 	res := strings.Split(strings.Trim(resource, "/"), "/")
 
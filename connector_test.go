@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/UniversityRadioYork/baps3-go"
+	"github.com/UniversityRadioYork/heimdallr/mockbifrost"
+)
+
+// TestMapMessage checks that renamed words are renamed, in both raw lines
+// and JSON, and that every other word passes through untouched.
+func TestMapMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		rename   map[string]string
+		msg      *baps3.Message
+		wantWord string
+		wantLine string
+	}{
+		{"renamed", map[string]string{"FILE": "TRACK"}, baps3.NewMessage(baps3.RsFile).AddArg("/a.mp3"), "TRACK", "TRACK /a.mp3"},
+		{"unmapped", map[string]string{"FILE": "TRACK"}, baps3.NewMessage(baps3.RsState).AddArg("Playing"), "STATE", "STATE Playing"},
+		{"no renames", nil, baps3.NewMessage(baps3.RsFile).AddArg("/a.mp3"), "FILE", "FILE /a.mp3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &bfConnector{name: "main", rename: tt.rename}
+			m := c.mapMessage(*tt.msg, time.Now())
+			if m.server != "main" {
+				t.Errorf("got server %q, want main", m.server)
+			}
+			if got := m.word(); got != tt.wantWord {
+				t.Errorf("got word %q, want %q", got, tt.wantWord)
+			}
+			if got := m.line(); got != tt.wantLine {
+				t.Errorf("got line %q, want %q", got, tt.wantLine)
+			}
+			if got := m.toJSON().Word; got != tt.wantWord {
+				t.Errorf("got JSON word %q, want %q", got, tt.wantWord)
+			}
+			// The message itself is left alone, for the snapshot
+			// and coalescer, which use the server's words.
+			if got, want := m.msg.String(), tt.msg.String(); got != want {
+				t.Errorf("message changed from %q to %q", want, got)
+			}
+		})
+	}
+}
+
+// TestConnectorReconnects plays a connector a mock server that greets it,
+// sends a message, hangs up, then greets it again, checking that clients
+// would see the whole story, and that commands get through.
+func TestConnectorReconnects(t *testing.T) {
+	srv, err := mockbifrost.NewServer("127.0.0.1:0", []mockbifrost.Step{
+		mockbifrost.Send(baps3.NewMessage(baps3.RsOhai).AddArg("mock")),
+		mockbifrost.Send(baps3.NewMessage(baps3.RsState).AddArg("Playing")),
+		mockbifrost.Drop(),
+		mockbifrost.Send(baps3.NewMessage(baps3.RsOhai).AddArg("mock")),
+		mockbifrost.Send(baps3.NewMessage(baps3.RsState).AddArg("Stopped")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	conf := defaultConfig()
+	conf.Reconnect = reconnectConfig{Base: duration{10 * time.Millisecond}, Max: duration{20 * time.Millisecond}}
+	updates := make(chan serverMessage)
+	connectors := newConnectorSet()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := new(sync.WaitGroup)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	startConnector(ctx, "main", server{Hostport: srv.Addr()}, conf, connectors, updates, nil, wg, testLogger())
+
+	want := []string{
+		"main connected", "main OHAI mock", "main STATE Playing",
+		"main disconnected",
+		"main connected", "main OHAI mock", "main STATE Stopped",
+	}
+	for i, w := range want {
+		select {
+		case m := <-updates:
+			got := m.String()
+			if m.event == "" {
+				got = m.server + " " + got
+			}
+			if got != w {
+				t.Fatalf("update %d: got %q, want %q", i, got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", w)
+		}
+	}
+
+	c, ok := connectors.get("main")
+	if !ok {
+		t.Fatal("connector not registered")
+	}
+	if !c.getStatus().Connected {
+		t.Error("connector not reported connected")
+	}
+	if err := c.command(*baps3.NewMessage(baps3.RqLoad).AddArg("/a.mp3"), nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the command to arrive", func() bool {
+		return len(srv.Received()) == 1
+	})
+	if got, want := srv.Received()[0], "load /a.mp3"; got != want {
+		t.Errorf("server got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import "sync"
+
+// consumer is anything the pool fans messages out to: a websocket
+// connection, or a /stream response.
+// The pool only calls these methods from its own goroutine.
+type consumer interface {
+	// send queues payload, in the consumer's format, without blocking.
+	// It returns false if the queue was full.
+	send(payload broadcastPayload) bool
+	// close hangs the consumer up, telling it the given close code and
+	// reason if it can.  Calls after the first do nothing, and send must
+	// not be called after it.
+	close(code int, reason string)
+
+	// wants returns whether the consumer wants payload.
+	wants(payload broadcastPayload) bool
+	// wantsMeta returns whether the consumer wants meta events.
+	wantsMeta() bool
+
+	// queued returns the number of frames waiting in the queue.
+	queued() int
+
+	// addr is the client's address, for logs and notifications.
+	addr() string
+	// info describes the consumer, for /admin/connections.  The pool
+	// fills in Since and Dropped itself.
+	info() connectionInfo
+}
+
+// filter holds the subscriptions and word filter of a consumer.
+// The pool reads them as it sends each message, while the consumer can
+// change them at any time, so they are all guarded by subsLock.
+type filter struct {
+	// subs is the set of server names whose messages the consumer
+	// receives, or nil if it receives every server's messages (including
+	// those of servers added later).
+	subs map[string]bool
+	// only, if not nil, is the set of message words the consumer
+	// receives; failing that, except is the set it doesn't.  Events are
+	// always received.
+	only, except map[string]bool
+	// meta is whether the consumer wants meta events.
+	meta     bool
+	subsLock sync.Mutex
+}
+
+// wants returns whether payload gets through the subscriptions and word
+// filter.
+func (f *filter) wants(payload broadcastPayload) bool {
+	f.subsLock.Lock()
+	defer f.subsLock.Unlock()
+	// Only notifications can be for no server in particular, and only
+	// subscriptions to a server they name can rule them out.
+	if f.subs != nil && payload.server != "" && !f.subs[payload.server] {
+		return false
+	}
+	if payload.word == "" {
+		return true
+	}
+	// Only one of only and except is ever set.
+	return wordPermitted(payload.word, f.only, f.except)
+}
+
+// setMeta turns meta events on or off.
+func (f *filter) setMeta(on bool) {
+	f.subsLock.Lock()
+	defer f.subsLock.Unlock()
+	f.meta = on
+}
+
+// wantsMeta returns whether meta events are on.
+func (f *filter) wantsMeta() bool {
+	f.subsLock.Lock()
+	defer f.subsLock.Unlock()
+	return f.meta
+}
+
+// describe returns a connectionInfo with only the subscriptions and word
+// filter filled in.
+func (f *filter) describe() connectionInfo {
+	f.subsLock.Lock()
+	defer f.subsLock.Unlock()
+
+	info := connectionInfo{
+		Only:   setWords(f.only),
+		Except: setWords(f.except),
+	}
+	if f.subs != nil {
+		info.Subscriptions = setWords(f.subs)
+		if info.Subscriptions == nil {
+			info.Subscriptions = []string{}
+		}
+	}
+	return info
+}
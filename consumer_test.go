@@ -0,0 +1,185 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeConsumer is a consumer that records what it is sent, for testing the
+// pool without any network.
+type fakeConsumer struct {
+	// room is how many more payloads send accepts before reporting the
+	// queue full.  The payloads are never taken off the queue.
+	room int
+	// sent holds the payloads sent, as strings.
+	sent []string
+	// closed is whether close was called, and code and reason what with.
+	closed     bool
+	code       int
+	reason     string
+	remoteAddr string
+
+	filter
+}
+
+func (c *fakeConsumer) send(payload broadcastPayload) bool {
+	if c.closed {
+		panic("send after close")
+	}
+	if c.room <= 0 {
+		return false
+	}
+	c.room--
+	c.sent = append(c.sent, string(payload.payload))
+	return true
+}
+
+func (c *fakeConsumer) close(code int, reason string) {
+	if c.closed {
+		return
+	}
+	c.closed, c.code, c.reason = true, code, reason
+}
+
+func (c *fakeConsumer) queued() int  { return len(c.sent) }
+func (c *fakeConsumer) addr() string { return c.remoteAddr }
+func (c *fakeConsumer) info() connectionInfo {
+	info := c.describe()
+	info.RemoteAddr = c.remoteAddr
+	return info
+}
+
+// newFakePool returns a pool, not running, so that tests can drive its
+// methods directly, holding conns.
+func newFakePool(config wspoolConfig, conns ...consumer) *Wspool {
+	wspool := NewWspool(config, nil, testLogger())
+	for _, c := range conns {
+		wspool.connections[c] = &connMeta{since: time.Now()}
+	}
+	return wspool
+}
+
+// TestFanOutCountsDelivered checks that fanOut counts only the connections
+// that actually got the payload.
+func TestFanOutCountsDelivered(t *testing.T) {
+	roomy := &fakeConsumer{room: 10}
+	full := &fakeConsumer{room: 0}
+	elsewhere := &fakeConsumer{room: 10, filter: filter{subs: map[string]bool{"other": true}}}
+	wspool := newFakePool(wspoolConfig{maxDrops: 10}, roomy, full, elsewhere)
+
+	payload := broadcastPayload{server: "main", word: "TIME", payload: []byte("TIME 1")}
+	if n := wspool.fanOut(payload); n != 1 {
+		t.Errorf("got %d, want only the connection with room", n)
+	}
+	if len(full.sent) != 0 || full.closed {
+		t.Errorf("full connection got %q, closed %v; want it to miss the payload but stay", full.sent, full.closed)
+	}
+}
+
+// TestDropPolicy checks that a consumer missing more than maxDrops messages
+// in a row is closed, and never sent anything again, while one that catches
+// up in time starts its count again.
+func TestDropPolicy(t *testing.T) {
+	slow := &fakeConsumer{}
+	recovering := &fakeConsumer{}
+	wspool := newFakePool(wspoolConfig{maxDrops: 2}, slow, recovering)
+	payload := broadcastPayload{server: "main", word: "TIME", payload: []byte("TIME 1")}
+
+	for i := 0; i < 2; i++ {
+		wspool.fanOut(payload)
+	}
+	if slow.closed || recovering.closed {
+		t.Fatal("closed before missing more than maxDrops")
+	}
+	recovering.room = 1
+	wspool.fanOut(payload)
+	if !slow.closed {
+		t.Fatal("slow consumer not closed after missing more than maxDrops")
+	}
+	if slow.code != websocket.ClosePolicyViolation || slow.reason != "too slow" {
+		t.Errorf("slow consumer closed with %d %q, want %d \"too slow\"", slow.code, slow.reason, websocket.ClosePolicyViolation)
+	}
+	if _, ok := wspool.connections[slow]; ok {
+		t.Error("slow consumer still in the pool")
+	}
+	if n := atomic.LoadUint64(&wspool.metrics.slowDisconnects); n != 1 {
+		t.Errorf("got %d slow disconnects, want 1", n)
+	}
+
+	// Having got one message, the recovering consumer can miss two more.
+	for i := 0; i < 2; i++ {
+		wspool.fanOut(payload)
+	}
+	if recovering.closed {
+		t.Error("recovering consumer closed, despite catching up")
+	}
+	if got := wspool.connections[recovering].dropped; got != 4 {
+		t.Errorf("recovering consumer dropped %d in total, want 4", got)
+	}
+}
+
+// TestFanOutFilters checks that fanOut sends consumers only what their
+// subscriptions, word filters and meta settings let through.
+func TestFanOutFilters(t *testing.T) {
+	all := &fakeConsumer{room: 10}
+	other := &fakeConsumer{room: 10, filter: filter{subs: map[string]bool{"other": true}}}
+	onlyState := &fakeConsumer{room: 10, filter: filter{only: map[string]bool{"STATE": true}}}
+	meta := &fakeConsumer{room: 10}
+	meta.setMeta(true)
+	wspool := newFakePool(wspoolConfig{}, all, other, onlyState, meta)
+
+	wspool.fanOut(broadcastPayload{server: "main", word: "TIME", payload: []byte("TIME 1")})
+	wspool.fanOut(broadcastPayload{server: "main", word: "STATE", payload: []byte("STATE Playing")})
+	wspool.fanOut(broadcastPayload{server: "main", payload: []byte("connected")})
+	wspool.fanOut(broadcastPayload{payload: []byte("clients"), match: consumer.wantsMeta})
+
+	tests := []struct {
+		name string
+		c    *fakeConsumer
+		want []string
+	}{
+		{"unfiltered", all, []string{"TIME 1", "STATE Playing", "connected"}},
+		{"subscribed elsewhere", other, nil},
+		{"only STATE", onlyState, []string{"STATE Playing", "connected"}},
+		{"meta", meta, []string{"TIME 1", "STATE Playing", "connected", "clients"}},
+	}
+	for _, tt := range tests {
+		if !equalStrings(tt.c.sent, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, tt.c.sent, tt.want)
+		}
+	}
+}
+
+// TestShutdownClosesConsumers checks that closing the broadcast channel
+// closes every consumer as going away.
+func TestShutdownClosesConsumers(t *testing.T) {
+	a, b := &fakeConsumer{}, &fakeConsumer{}
+	wspool := newFakePool(wspoolConfig{}, a, b)
+	wspool.handleBroadcast(broadcastPayload{}, false)
+
+	for _, c := range []*fakeConsumer{a, b} {
+		if !c.closed || c.code != websocket.CloseGoingAway {
+			t.Errorf("got closed %v with %d, want closed with %d", c.closed, c.code, websocket.CloseGoingAway)
+		}
+	}
+	if len(wspool.connections) != 0 || !wspool.quit {
+		t.Error("pool not emptied and quitting")
+	}
+}
+
+// TestEmptyBroadcastSkipped checks that an empty payload is never forwarded
+// to consumers, while the next non-empty one is.
+func TestEmptyBroadcastSkipped(t *testing.T) {
+	c := &fakeConsumer{room: 10}
+	wspool := newFakePool(wspoolConfig{}, c)
+
+	wspool.handleBroadcast(broadcastPayload{server: "main", payload: []byte{}}, true)
+	wspool.handleBroadcast(broadcastPayload{server: "main"}, true)
+	wspool.handleBroadcast(broadcastPayload{server: "main", word: "TIME", payload: []byte("TIME 1")}, true)
+	if want := []string{"TIME 1"}; !equalStrings(c.sent, want) {
+		t.Errorf("got %q, want %q", c.sent, want)
+	}
+}
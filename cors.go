@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// corsHandler wraps h so that it sends CORS headers to browsers on the
+// origins in conf.CORSOrigins, and answers their preflight requests.
+// Websocket upgrades are left alone, as originChecker deals with those.
+//
+// If conf.CORSOrigins is empty, h is returned as-is, sending no CORS headers.
+func corsHandler(h http.Handler, conf httpServer) http.Handler {
+	if len(conf.CORSOrigins) == 0 {
+		return h
+	}
+	methods := strings.Join(conf.CORSMethods, ", ")
+	headers := strings.Join(conf.CORSHeaders, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || websocket.IsWebSocketUpgrade(r) || !corsAllowed(conf.CORSOrigins, origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			if headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// corsAllowed returns whether origin matches any of the patterns in allowed,
+// as in httpServer.AllowedOrigins.
+func corsAllowed(allowed []string, origin string) bool {
+	for _, pattern := range allowed {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// history remembers the last few messages from each server, so that clients
+// can ask for recent history, such as to fill a scrolling log, as well as the
+// latest state.
+//
+// Like stateCache, it is updated by the main loop and read by the pool, so
+// is guarded by a lock.  A nil *history remembers nothing.
+type history struct {
+	// size is the number of messages remembered per server.
+	size int
+
+	lock    sync.Mutex
+	servers map[string]*historyRing
+}
+
+// historyRing is a ring buffer of one server's latest messages.
+type historyRing struct {
+	// msgs holds the messages, the oldest at start once the ring is full.
+	msgs  []serverMessage
+	start int
+}
+
+// newHistory creates a history remembering size messages per server, or nil,
+// remembering nothing, if size isn't positive.
+func newHistory(size int) *history {
+	if size <= 0 {
+		return nil
+	}
+	return &history{size: size, servers: make(map[string]*historyRing)}
+}
+
+// add remembers m, pushing out the server's oldest message if need be.
+// Events aren't remembered.
+func (h *history) add(m serverMessage) {
+	if h == nil || m.event != "" {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	r, ok := h.servers[m.server]
+	if !ok {
+		r = &historyRing{msgs: make([]serverMessage, 0, h.size)}
+		h.servers[m.server] = r
+	}
+	if len(r.msgs) < h.size {
+		r.msgs = append(r.msgs, m)
+		return
+	}
+	r.msgs[r.start] = m
+	r.start = (r.start + 1) % h.size
+}
+
+// last returns, oldest first, up to n of the latest messages from server, or
+// from every server if server is "".
+func (h *history) last(server string, n int) (msgs []serverMessage) {
+	if h == nil {
+		return nil
+	}
+
+	h.lock.Lock()
+	for name, r := range h.servers {
+		if server == "" || name == server {
+			msgs = append(msgs, r.msgs[r.start:]...)
+			msgs = append(msgs, r.msgs[:r.start]...)
+		}
+	}
+	h.lock.Unlock()
+
+	// Each server's messages are already in order, so a stable sort
+	// keeps them so even if times tie.
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].received.Before(msgs[j].received)
+	})
+	if n < len(msgs) {
+		msgs = msgs[len(msgs)-n:]
+	}
+	return
+}
+
+// forget drops everything remembered about server, such as when it is
+// removed from the config.
+func (h *history) forget(server string) {
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.servers, server)
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 type httpRequest struct {
@@ -16,59 +19,538 @@ type httpRequest struct {
 	resCh    chan<- interface{}
 }
 
-func initHTTP(connectors []*bfConnector, wspool *Wspool, log *log.Logger) http.Handler {
+// initHTTP creates the handler for listener l, serving only the routes it
+// asks for.
+func initHTTP(conf httpServer, l listener, started time.Time, connectors *connectorSet, cache *stateCache, wspool *Wspool, brokers []*brokerSink, reloads chan<- reloadRequest, log *leveledLogger) http.Handler {
 	r := mux.NewRouter()
-	r.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+
+	if l.serves(routeWS) {
+		r.HandleFunc("/ws", wsHandler(conf, newUpgrader(conf), connectors, wspool, log))
+		r.HandleFunc("/stream", streamHandler(conf, connectors, wspool, log)).Methods("GET")
+	}
+	if l.serves(routeHealth) {
+		r.HandleFunc("/healthz", healthHandler(conf, started, connectors, wspool, log)).Methods("GET")
+		r.HandleFunc("/version", versionHandler(started, log)).Methods("GET")
+		r.HandleFunc("/metrics", metricsHandler(connectors, wspool, brokers, log)).Methods("GET")
+	}
+	if l.serves(routeREST) {
+		r.HandleFunc("/servers", gzipped(requireAuth(conf.readToken(), serversHandler(connectors, log)))).Methods("GET")
+		r.HandleFunc("/servers/{name}/state", gzipped(requireAuth(conf.readToken(), stateHandler(connectors, cache, log)))).Methods("GET")
+		r.HandleFunc("/servers/{name}/stats", gzipped(requireAuth(conf.readToken(), statsHandler(connectors, log)))).Methods("GET")
+		installConnectors(r, conf.readToken(), connectors, log)
+	}
+	if l.serves(routeAdmin) {
+		r.HandleFunc("/admin/connections", requireAdmin(conf.AuthToken, connectionsHandler(wspool, log))).Methods("GET")
+		r.HandleFunc("/admin/reload", requireAdmin(conf.AuthToken, reloadHandler(reloads, log))).Methods("POST")
+		r.HandleFunc("/admin/notify", requireAdmin(conf.AuthToken, notifyHandler(wspool, log))).Methods("POST")
+		r.HandleFunc("/admin/servers/{name}/reconnect", requireAdmin(conf.AuthToken, reconnectHandler(connectors, log))).Methods("POST")
+	}
+	if l.serves(routeStatic) {
+		r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
+	}
+
+	var h http.Handler = r
+	if prefix := conf.pathPrefix(); prefix != "" {
+		h = stripPathPrefix(prefix, h)
+	}
+	return logRequests(corsHandler(h, conf), log)
+}
+
+// stripPathPrefix wraps h so that it serves only paths under prefix, which
+// has no trailing slash, as if they were at the root; anything else is 404.
+// Unlike http.StripPrefix, the prefix must be a whole number of path
+// segments, so a prefix of /radio serves /radio and /radio/ws, but not
+// /radiows.
+func stripPathPrefix(prefix string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, prefix)
+		if len(rest) == len(r.URL.Path) || (rest != "" && rest[0] != '/') {
+			http.NotFound(w, r)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// wsHandler creates the handler for websocket upgrade requests, which
+// upgrader upgrades.
+// Each upgraded connection is registered with wspool, and, if it presented
+// the auth token (if any), may send commands to any of the connectors in
+// connectors.
+func wsHandler(conf httpServer, upgrader *websocket.Upgrader, connectors *connectorSet, wspool *Wspool, log *leveledLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			http.Error(w, "Method not allowed", 405)
 			return
 		}
+		if !upgrader.CheckOrigin(r) {
+			http.Error(w, "Origin not allowed", 403)
+			return
+		}
+		if !authorized(r, conf.readToken()) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		canCommand := authorized(r, conf.AuthToken)
+
+		if !wspool.acquire(conf.MaxConnections) {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+			return
+		}
+		// This handler lasts as long as the connection does.
+		defer wspool.release()
+
 		ws, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Println(err)
+			log.Warnf("websocket upgrade failed: %s\n", err)
 			return
 		}
-		c := &wsConn{send: make(chan []byte, 256), ws: ws}
-		wspool.register <- c
-		c.writeLoop()
-	})
+		c := wspool.newConn(ws)
+		c.canCommand = canCommand
+		c.frameType = conf.frameType()
+		// The upgrader has already echoed the subprotocol back.
+		if format, ok := subprotocolFormats[ws.Subprotocol()]; ok {
+			c.format = format
+			if format == formatJSON {
+				c.frameType = websocket.TextMessage
+			}
+		}
+		c.readLimit = conf.MaxMessageSize
+		c.limiter = newTokenBucket(conf.CommandRate, conf.CommandBurst)
+		c.maxInFlight = conf.MaxInFlight
+		if !wspool.add(c) {
+			// The pool has gone, so just say goodbye.
+			c.close(websocket.CloseGoingAway, "server shutting down")
+			c.writeLoop(wspool)
+			return
+		}
+		go c.readLoop(connectors, wspool)
+		c.writeLoop(wspool)
+	}
+}
+
+// retryAfter is the Retry-After header sent to websocket clients refused
+// because there are too many connections.
+const retryAfter = "30"
+
+// healthResponse is the body of a /healthz response.
+type healthResponse struct {
+	Healthy bool                       `json:"healthy"`
+	Servers map[string]connectorStatus `json:"servers"`
+
+	// Connections is the number of websocket clients, and
+	// MaxConnections the most allowed (or 0 if unlimited).
+	Connections    int64 `json:"connections"`
+	MaxConnections int   `json:"maxConnections"`
+
+	uptime
+}
+
+// healthHandler creates the handler for /healthz, which reports the status
+// of each connector, how many clients are connected, and the uptime since
+// started.
+// It responds 503 unless every connector (if conf.HealthRequire is
+// healthAll) or at least one (if it is healthAny) is connected.
+func healthHandler(conf httpServer, started time.Time, connectors *connectorSet, wspool *Wspool, log *leveledLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := healthResponse{
+			Servers:        make(map[string]connectorStatus),
+			Connections:    wspool.count(),
+			MaxConnections: conf.MaxConnections,
+			uptime:         uptimeSince(started, time.Now()),
+		}
+
+		up := 0
+		all := connectors.all()
+		for _, c := range all {
+			status := c.getStatus()
+			res.Servers[c.name] = status
+			if status.Connected {
+				up++
+			}
+		}
+
+		if conf.HealthRequire == healthAny {
+			res.Healthy = 0 < up
+		} else {
+			res.Healthy = up == len(all)
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		if !res.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := dumpJSON(w, res); err != nil {
+			log.Errorf("%s\n", err)
+		}
+	}
+}
+
+// serverListing is the body of a /servers response, for one server.
+type serverListing struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+	Role        string `json:"role,omitempty"`
+	ReadOnly    bool   `json:"readOnly"`
+	connectorStatus
+}
+
+// serverListings lists every server in connectors.
+func serverListings(connectors *connectorSet) []serverListing {
+	res := []serverListing{}
+	for _, c := range connectors.all() {
+		res = append(res, serverListing{
+			Name:            c.name,
+			DisplayName:     c.displayName,
+			Role:            c.role,
+			ReadOnly:        c.readOnly,
+			connectorStatus: c.getStatus(),
+		})
+	}
+	return res
+}
+
+// serversEvent is the frame sent to new websocket clients, listing the
+// servers, so they needn't ask /servers.
+type serversEvent struct {
+	Event   string          `json:"event"`
+	Servers []serverListing `json:"servers"`
+}
+
+// serversGreeting returns the serversEvent for connectors, or nil if it
+// can't be marshalled.
+func serversGreeting(connectors *connectorSet, log *leveledLogger) []byte {
+	j, err := json.Marshal(serversEvent{Event: evServers, Servers: serverListings(connectors)})
+	if err != nil {
+		log.Errorf("%s\n", err)
+		return nil
+	}
+	return j
+}
+
+// serversHandler creates the handler for /servers, which lists every
+// configured server and its status.
+func serversHandler(connectors *connectorSet, log *leveledLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := serverListings(connectors)
+
+		w.Header().Add("Content-Type", "application/json")
+		if err := dumpJSON(w, res); err != nil {
+			log.Errorf("%s\n", err)
+		}
+	}
+}
+
+// stateResponse is the body of a /servers/{name}/state response.
+type stateResponse struct {
+	Name string `json:"name"`
+	connectorStatus
+	Messages []jsonMessage `json:"messages"`
+}
+
+// stateHandler creates the handler for /servers/{name}/state, which returns
+// the cached latest state of a server.
+// It responds 404 if there is no such server, and 503 if it has never been
+// connected (and so has no state to speak of).
+func stateHandler(connectors *connectorSet, cache *stateCache, log *leveledLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		c, ok := connectors.get(name)
+		if !ok {
+			http.Error(w, "Unknown server", http.StatusNotFound)
+			return
+		}
+		status := c.getStatus()
+		if !status.everConnected {
+			http.Error(w, "Server never connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		res := stateResponse{Name: name, connectorStatus: status, Messages: []jsonMessage{}}
+		for _, m := range cache.snapshot(name) {
+			if m.event == "" {
+				res.Messages = append(res.Messages, m.toJSON())
+			}
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		if err := dumpJSON(w, res); err != nil {
+			log.Errorf("%s\n", err)
+		}
+	}
+}
 
-	for i := range connectors {
-		installConnector(r, connectors[i])
+// connectionsResponse is the body of an /admin/connections response.
+type connectionsResponse struct {
+	Count       int              `json:"count"`
+	Connections []connectionInfo `json:"connections"`
+}
+
+// connectionsHandler creates the handler for /admin/connections, which lists
+// the websocket clients in wspool.
+func connectionsHandler(wspool *Wspool, log *leveledLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conns, ok := wspool.connectionList()
+		if !ok {
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		res := connectionsResponse{Count: len(conns), Connections: conns}
+
+		w.Header().Add("Content-Type", "application/json")
+		if err := dumpJSON(w, res); err != nil {
+			log.Errorf("%s\n", err)
+		}
+	}
+}
+
+// reloadError is the body of a failed /admin/reload response.
+type reloadError struct {
+	Error string `json:"error"`
+}
+
+// reloadHandler creates the handler for /admin/reload, which reloads the
+// config file as SIGHUP does, and reports which servers were added and
+// removed.
+// It responds 400, leaving the running config alone, if the new config is
+// invalid, and 503 if heimdallr is shutting down.
+func reloadHandler(reloads chan<- reloadRequest, log *leveledLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Buffered, so that the main loop never waits on us.
+		resCh := make(chan reloadResult, 1)
+		select {
+		case reloads <- reloadRequest{resCh: resCh}:
+		case <-r.Context().Done():
+			return
+		}
+		res := <-resCh
+
+		w.Header().Add("Content-Type", "application/json")
+		var body interface{}
+		switch {
+		case res.err == errShuttingDown:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			body = reloadError{Error: res.err.Error()}
+		case res.err != nil:
+			w.WriteHeader(http.StatusBadRequest)
+			body = reloadError{Error: res.err.Error()}
+		default:
+			d := res.diff
+			// Clients would rather see [] than null.
+			if d.Added == nil {
+				d.Added = []string{}
+			}
+			if d.Removed == nil {
+				d.Removed = []string{}
+			}
+			body = d
+		}
+		if err := dumpJSON(w, body); err != nil {
+			log.Errorf("%s\n", err)
+		}
+	}
+}
+
+// notifyRequest is the body of a /admin/notify request.
+type notifyRequest struct {
+	// Message is the notification, any JSON value, sent to clients as is.
+	Message json.RawMessage `json:"message"`
+
+	// Server, if set, sends the notification only to clients receiving
+	// that server's messages.
+	Server string `json:"server"`
+	// RemoteAddr, if set, sends the notification only to clients at that
+	// address: either a host, or a host:port.
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+// match returns the predicate picking the clients rq is for, or nil if it is
+// for every client.
+func (rq notifyRequest) match() func(consumer) bool {
+	if rq.RemoteAddr == "" {
+		return nil
+	}
+	return func(c consumer) bool {
+		if c.addr() == rq.RemoteAddr {
+			return true
+		}
+		host, _, err := net.SplitHostPort(c.addr())
+		return err == nil && host == rq.RemoteAddr
+	}
+}
+
+// notifyEvent is the frame carrying a notification to clients.
+type notifyEvent struct {
+	Event   string          `json:"event"`
+	Server  string          `json:"server,omitempty"`
+	Message json.RawMessage `json:"message"`
+}
+
+// notifyResponse is the body of a successful /admin/notify response.
+type notifyResponse struct {
+	// Clients is the number of clients the notification was queued for.
+	Clients int `json:"clients"`
+}
+
+// maxNotifySize is the largest /admin/notify request body accepted.
+const maxNotifySize = 64 * 1024
+
+// notifyHandler creates the handler for POST /admin/notify, which sends a
+// notification, rather than a Bifrost message, to the websocket clients
+// matching the request.
+// It responds 400 if the request is malformed, and 503 if heimdallr is
+// shutting down.
+func notifyHandler(wspool *Wspool, log *leveledLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rq notifyRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNotifySize)).Decode(&rq); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(rq.Message) == 0 {
+			http.Error(w, "Bad request: no message", http.StatusBadRequest)
+			return
+		}
+
+		frame, err := json.Marshal(notifyEvent{Event: evNotify, Server: rq.Server, Message: rq.Message})
+		if err != nil {
+			log.Errorf("%s\n", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		n, ok := wspool.notifyClients(broadcastPayload{server: rq.Server, payload: frame, match: rq.match()})
+		if !ok {
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		log.Infof("sent notification from %s to %d client(s)\n", r.RemoteAddr, n)
+
+		w.Header().Add("Content-Type", "application/json")
+		if err := dumpJSON(w, notifyResponse{Clients: n}); err != nil {
+			log.Errorf("%s\n", err)
+		}
+	}
+}
+
+// reconnectResponse is the body of a /admin/servers/{name}/reconnect
+// response.
+type reconnectResponse struct {
+	Server       string `json:"server"`
+	Reconnecting bool   `json:"reconnecting"`
+}
+
+// reconnectHandler creates the handler for POST
+// /admin/servers/{name}/reconnect, which makes one server's connection hang
+// up and redial, leaving every other server and client alone.
+// It responds 202 once the reconnect is asked for, 404 if there is no such
+// server, and 409 if a reconnect is already pending.
+func reconnectHandler(connectors *connectorSet, log *leveledLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		c, ok := connectors.get(name)
+		if !ok {
+			http.Error(w, "Unknown server", http.StatusNotFound)
+			return
+		}
+		if !c.conn.reconnect() {
+			http.Error(w, "Reconnect already in progress", http.StatusConflict)
+			return
+		}
+		log.Infof("reconnecting server %s on request from %s\n", name, r.RemoteAddr)
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := dumpJSON(w, reconnectResponse{Server: name, Reconnecting: true}); err != nil {
+			log.Errorf("%s\n", err)
+		}
 	}
+}
+
+// statsHandler creates the handler for /servers/{name}/stats, which reports
+// how busy a server is.
+// It responds 404 if there is no such server.
+func statsHandler(connectors *connectorSet, log *leveledLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		c, ok := connectors.get(name)
+		if !ok {
+			http.Error(w, "Unknown server", http.StatusNotFound)
+			return
+		}
+
+		res := c.stats.snapshot(time.Now())
+		res.Name = name
 
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
+		w.Header().Add("Content-Type", "application/json")
+		if err := dumpJSON(w, res); err != nil {
+			log.Errorf("%s\n", err)
+		}
+	}
+}
 
-	return r
+// connectorName returns the name of the connector addressed by the resource
+// path, which is its first segment.
+func connectorName(path string) string {
+	return strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
 }
 
-func installConnector(router *mux.Router, connector *bfConnector) {
+// installConnectors routes requests for /<name> and below to the connector
+// called name in connectors, provided they present token (if set).
+// The set of connectors may change at run-time, so the route looks them up
+// per request.
+func installConnectors(router *mux.Router, token string, connectors *connectorSet, log *leveledLogger) {
+	match := func(r *http.Request, rm *mux.RouteMatch) bool {
+		_, ok := connectors.get(connectorName(r.URL.Path))
+		return ok
+	}
+
 	fn := func(w http.ResponseWriter, r *http.Request) {
+		connector, ok := connectors.get(connectorName(r.URL.Path))
+		if !ok {
+			// It was removed since the route matched.
+			http.NotFound(w, r)
+			return
+		}
+
 		resCh := make(chan interface{})
 
-		fmt.Printf("sending request to %s\n", connector.name)
+		log.Debugf("sending request to %s\n", connector.name)
 
 		resource := r.URL.Path
 
-		w.Header().Add("Content-Type", "application/json")
-		connector.reqCh <- httpRequest{
+		select {
+		case connector.reqCh <- httpRequest{
 			resource,
 			resCh,
+		}:
+		case <-connector.done:
+			http.NotFound(w, r)
+			return
 		}
 
+		w.Header().Add("Content-Type", "application/json")
 		select {
 		case res := <-resCh:
 			err := dumpJSON(w, res)
 			if err != nil {
-				fmt.Println(err)
+				log.Errorf("%s\n", err)
 				break
 			}
 		}
 	}
 
-	router.HandleFunc("/"+connector.name, fn)
-	router.HandleFunc("/"+connector.name+"/", fn)
-	router.PathPrefix("/" + connector.name + "/").HandlerFunc(fn)
+	router.MatcherFunc(match).HandlerFunc(gzipped(requireAuth(token, fn)))
 }
 
 // dumpJSON dumps the JSON marshalling of res into w.
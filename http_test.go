@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestPathPrefix checks that, with a path prefix, routes are served only
+// under the prefix, and only where the prefix ends at a slash.
+func TestPathPrefix(t *testing.T) {
+	conf := defaultConfig().HTTP
+	conf.PathPrefix = "/radio/"
+	wspool := startTestPool(t, conf)
+	h := initHTTP(conf, listener{Routes: []string{routeHealth, routeWS}}, time.Now(), newConnectorSet(), nil, wspool, nil, nil, testLogger())
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/radio/version", http.StatusOK},
+		{"/radio/healthz", http.StatusOK},
+		{"/version", http.StatusNotFound},
+		{"/radioversion", http.StatusNotFound},
+		{"/radiows", http.StatusNotFound},
+		{"/radio", http.StatusNotFound},
+		{"/radio/", http.StatusNotFound},
+		{"/other/version", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("GET %s: got status %d, want %d", tt.path, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
+// TestPathPrefixWebsocket checks that websockets upgrade under the prefix.
+func TestPathPrefixWebsocket(t *testing.T) {
+	conf := defaultConfig().HTTP
+	conf.PathPrefix = "/radio"
+	wspool := startTestPool(t, conf)
+	srv := httptest.NewServer(initHTTP(conf, listener{Routes: []string{routeWS}}, time.Now(), newConnectorSet(), nil, wspool, nil, nil, testLogger()))
+	defer srv.Close()
+
+	srv.URL += "/radio"
+	dialTestWS(t, srv)
+	waitForConnections(t, wspool, 1)
+}
+
+// TestConnectionsAfterStop checks that /admin/connections answers, rather
+// than hanging, once the pool has stopped.
+func TestConnectionsAfterStop(t *testing.T) {
+	conf := defaultConfig().HTTP
+	conf.AuthToken = "secret"
+	wspool := startTestPool(t, conf)
+	h := initHTTP(conf, listener{Routes: []string{routeAdmin}}, time.Now(), newConnectorSet(), nil, wspool, nil, nil, testLogger())
+	stopTestPool(wspool)
+
+	done := make(chan int, 1)
+	go func() {
+		req := httptest.NewRequest("GET", "/admin/connections?token=secret", nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		done <- rec.Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("got status %d, want 503", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request hung")
+	}
+}
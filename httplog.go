@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// statusRecorder is a http.ResponseWriter that remembers the status code
+// written through it.
+// It passes hijacking and flushing through, so websocket upgrades and
+// /stream still work; a hijacked connection is recorded as 101 Switching
+// Protocols.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+
+	// onHijack, if not nil, is called once the connection is hijacked.
+	onHijack func()
+}
+
+// WriteHeader records, and writes, the status code.
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes b, recording an implicit 200 OK if no status was written.
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush sends anything buffered to the client, if the underlying writer can,
+// recording an implicit 200 OK if no status was written.
+func (r *statusRecorder) Flush() {
+	f, ok := r.ResponseWriter.(http.Flusher)
+	if !ok {
+		return
+	}
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	f.Flush()
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack hijacks the underlying connection, if it can be.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		r.hijacked = true
+		r.status = http.StatusSwitchingProtocols
+		if r.onHijack != nil {
+			r.onHijack()
+		}
+	}
+	return conn, rw, err
+}
+
+// logRequests wraps h so that it logs the method, path, remote address,
+// status and duration of each request.
+//
+// Websocket upgrades are logged twice: once when they succeed (or fail), and
+// again when the connection, which h serves until it closes, closes.
+func logRequests(h http.Handler, log *leveledLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		if !websocket.IsWebSocketUpgrade(r) {
+			h.ServeHTTP(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			log.Infof("http %s %s from %s: %d in %s\n", r.Method, r.URL.Path, r.RemoteAddr, rec.status, time.Since(start))
+			return
+		}
+
+		rec.onHijack = func() {
+			log.Infof("websocket upgrade %s from %s: %d in %s\n", r.URL.Path, r.RemoteAddr, http.StatusSwitchingProtocols, time.Since(start))
+		}
+		h.ServeHTTP(rec, r)
+		if !rec.hijacked {
+			log.Warnf("websocket upgrade %s from %s failed: %d in %s\n", r.URL.Path, r.RemoteAddr, rec.status, time.Since(start))
+			return
+		}
+		log.Infof("websocket %s from %s closed after %s\n", r.URL.Path, r.RemoteAddr, time.Since(start))
+	})
+}
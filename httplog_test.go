@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestStreamThroughLogging checks that a Server-Sent Event reaches a /stream
+// client through the whole handler chain, logging included, which must pass
+// flushing through.
+func TestStreamThroughLogging(t *testing.T) {
+	conf := defaultConfig().HTTP
+	wspool := startTestPool(t, conf)
+	h := initHTTP(conf, listener{Routes: []string{routeWS}}, time.Now(), newConnectorSet(), nil, wspool, nil, nil, testLogger())
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("got Content-Type %q, want text/event-stream", ct)
+	}
+
+	waitForConnections(t, wspool, 1)
+	wspool.broadcast <- broadcastPayload{server: "main", word: "STATE", payload: []byte("STATE Playing")}
+
+	got := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(res.Body).ReadString('\n')
+		got <- line
+	}()
+	select {
+	case line := <-got:
+		if want := "data: STATE Playing\n"; line != want {
+			t.Errorf("got %q, want %q", line, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event never arrived")
+	}
+}
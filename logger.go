@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// logLevel is the severity of a log message.
+type logLevel int
+
+// Log levels, from least to most severe.
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// levelNames maps the names of log levels, as used in the config, to levels.
+var levelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// levelTags are the prefixes of messages at each log level.
+var levelTags = map[logLevel]string{
+	levelDebug: "[D] ",
+	levelInfo:  "[I] ",
+	levelWarn:  "[W] ",
+	levelError: "[E] ",
+}
+
+// parseLogLevel looks up the log level called name.
+func parseLogLevel(name string) (logLevel, error) {
+	level, ok := levelNames[strings.ToLower(name)]
+	if !ok {
+		return levelInfo, fmt.Errorf("unknown log level: %s", name)
+	}
+	return level, nil
+}
+
+// leveledLogger is a thin wrapper over log.Logger that tags each message
+// with a level, and discards messages below a minimum level.
+type leveledLogger struct {
+	out   *log.Logger
+	level logLevel
+}
+
+// newLeveledLogger creates a leveledLogger writing to w messages of at least
+// the given level.
+func newLeveledLogger(w io.Writer, level logLevel) *leveledLogger {
+	return &leveledLogger{out: log.New(w, "", log.Lshortfile), level: level}
+}
+
+// logf logs a message at level, if it is high enough.
+func (l *leveledLogger) logf(level logLevel, format string, a ...interface{}) {
+	if level < l.level {
+		return
+	}
+	// Skip logf and its caller (Debugf etc.), so Lshortfile reports the
+	// actual call site.  A failed log write has nowhere to be reported.
+	_ = l.out.Output(3, levelTags[level]+fmt.Sprintf(format, a...))
+}
+
+// Debugf logs a message useful only when debugging heimdallr.
+func (l *leveledLogger) Debugf(format string, a ...interface{}) {
+	l.logf(levelDebug, format, a...)
+}
+
+// Infof logs a message about heimdallr's normal operation.
+func (l *leveledLogger) Infof(format string, a ...interface{}) {
+	l.logf(levelInfo, format, a...)
+}
+
+// Warnf logs a message about something going wrong that heimdallr can
+// recover from.
+func (l *leveledLogger) Warnf(format string, a ...interface{}) {
+	l.logf(levelWarn, format, a...)
+}
+
+// Errorf logs a message about something going wrong that an operator should
+// look into.
+func (l *leveledLogger) Errorf(format string, a ...interface{}) {
+	l.logf(levelError, format, a...)
+}
+
+// Fatalf logs an error message, then exits heimdallr.
+func (l *leveledLogger) Fatalf(format string, a ...interface{}) {
+	l.logf(levelError, format, a...)
+	os.Exit(1)
+}
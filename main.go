@@ -1,114 +1,453 @@
 package main
 
 import (
-	"fmt"
-	"io/ioutil"
-	"log"
+	"context"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
 	"sync"
 	"syscall"
+	"time"
 
-	"github.com/BurntSushi/toml"
-	"github.com/UniversityRadioYork/baps3-go"
 	"github.com/docopt/docopt-go"
 )
 
-type server struct {
-	Hostport string
+// startupFailure reports that a required server failed its first attempt at
+// connecting, and mustn't be retried.
+type startupFailure struct {
+	name string
+	err  error
 }
 
-type httpServer struct {
-	Hostport string
-}
-
-// Config is a struct containing the configuration for an instance of Bifrost.
-type Config struct {
-	Servers map[string]server
-	HTTP    httpServer
-}
-
-func killConnectors(connectors []*bfConnector) {
-	for _, c := range connectors {
-		close(c.reqCh)
+// startConnector creates a connector for server s, adds it to connectors,
+// and starts it.  The connector runs until ctx is cancelled, or it is
+// stopped.
+// If failures is not nil, a required server that mustn't be retried on
+// startup reports failing its first attempt there, without blocking.
+func startConnector(ctx context.Context, name string, s server, conf Config, connectors *connectorSet, resCh chan<- serverMessage, failures chan<- startupFailure, wg *sync.WaitGroup, logger *leveledLogger) {
+	// Goroutines for the heimdallr connector, and its upstream
+	// connection.
+	wg.Add(2)
+	c := initBfConnector(name, s, conf.Reconnect, resCh, wg, logger)
+	if failures != nil && s.Required && !s.retryOnStartup() {
+		c.conn.failFast = func(err error) {
+			select {
+			case failures <- startupFailure{name: name, err: err}:
+			default:
+			}
+		}
 	}
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.done = ctx.Done()
+	connectors.add(c)
+	go c.Run(ctx)
 }
 func parseArgs() (args map[string]interface{}, err error) {
 	usage := `heimdallr.
 
 Usage:
-  heimdallr [-c <configfile>]
+  heimdallr [-c <configfiles>] [--dry-run]
   heimdallr -h
   heimdallr -v
 
 Options:
-  -c --config=<configfile>    Path to heimdallr config file [default: config.toml].
+  -c --config=<configfiles>   Comma-separated paths to heimdallr config files,
+                              merged in order, or - for stdin [default: config.toml].
+  --dry-run                   Check the config file, summarise it, and exit.
   -h --help                   Show this help message.
   -v --version                Show version.`
 
-	args, err = docopt.Parse(usage, nil, true, "heimdallr 0.0", false)
+	args, err = docopt.Parse(usage, nil, true, versionString(), false)
 	return
 }
 
 func main() {
-	logger := log.New(os.Stdout, "[-] ", log.Lshortfile)
+	// started is reported, with the uptime since, by /healthz and
+	// /version.
+	started := time.Now()
+	logger := newLeveledLogger(os.Stdout, levelInfo)
 	args, err := parseArgs()
 	if err != nil {
-		logger.Fatal("Error parsing args: " + err.Error())
+		logger.Fatalf("Error parsing args: %s\n", err)
 	}
-	conffile, err := ioutil.ReadFile(args["--config"].(string))
+	confPaths, err := resolveConfigPaths(args["--config"].(string))
 	if err != nil {
-		logger.Fatal(err)
+		logger.Fatalf("%s\n", err)
 	}
-	var conf Config
-	if _, err := toml.Decode(string(conffile), &conf); err != nil {
-		logger.Fatal(err)
+	conf, err := loadConfig(confPaths)
+	if err != nil {
+		logger.Fatalf("%s\n", err)
+	}
+	for _, w := range conf.warnings() {
+		logger.Warnf("%s\n", w)
+	}
+	if args["--dry-run"].(bool) {
+		summariseConfig(os.Stdout, conf)
+		os.Exit(0)
 	}
+	// loadConfig has already validated this.
+	logger.level, _ = parseLogLevel(conf.LogLevel)
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
 
-	resCh := make(chan baps3.Message)
+	resCh := make(chan serverMessage, conf.UpdateBuffer)
 
-	connectors := []*bfConnector{}
+	connectors := newConnectorSet()
 
 	wg := new(sync.WaitGroup)
 
+	// ctx is cancelled on shutting down, stopping every connector.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Each server fails fast at most once, so this never fills up.
+	failures := make(chan startupFailure, len(conf.Servers))
 	for name, s := range conf.Servers {
-		c := initBfConnector(name, resCh, wg, logger)
-		connectors = append(connectors, c)
-		c.conn.Connect(s.Hostport)
-		go c.Run()
+		startConnector(ctx, name, s, conf, connectors, resCh, failures, wg, logger)
+	}
+
+	rec, err := newRecorder(conf.RecordFile, conf.RecordAllow, conf.RecordDeny, wg, logger)
+	if err != nil {
+		logger.Fatalf("can't record messages: %s\n", err)
+	}
+
+	// brokers connect, and reconnect, on their own, so are started
+	// whether or not they are reachable.
+	var brokers []*brokerSink
+	if conf.NATS.URL != "" {
+		brokers = append(brokers, newNATSSink(ctx, conf.NATS, conf.Reconnect, wg, logger))
+	}
+	if conf.Redis.Addr != "" {
+		brokers = append(brokers, newRedisSink(ctx, conf.Redis, conf.Reconnect, wg, logger))
 	}
 
-	// Goroutine for the heimdallr connector, and the lower-level
-	// baps3-go connector.
-	wg.Add(len(connectors) * 2)
-	wspool := NewWspool(wg)
-	initAndStartHTTP(conf.HTTP, connectors, wspool, logger)
+	cache := newStateCache(conf.Snapshot.Words, conf.Snapshot.TTL.Duration)
+	hist := newHistory(conf.History.Size)
+	// history stays nil, telling clients history is off, unless it's on.
+	var history func(string, int) []broadcastPayload
+	if hist != nil {
+		history = func(server string, n int) []broadcastPayload {
+			return packAll(hist.last(server, n), conf.HTTP.packOptions(), logger)
+		}
+	}
+	wspool := NewWspool(wspoolConfig{
+		sendBuffer:     conf.HTTP.SendBuffer,
+		maxConnections: conf.HTTP.MaxConnections,
+		maxDrops:       conf.HTTP.MaxDrops,
+		dropGrace:      conf.HTTP.DropGrace.Duration,
+		timeouts: wsTimeouts{
+			writeWait:   conf.HTTP.WriteWait.Duration,
+			pongWait:    conf.HTTP.PongWait.Duration,
+			pingPeriod:  conf.HTTP.PingPeriod.Duration,
+			heartbeat:   conf.HTTP.Heartbeat.Duration,
+			batchWindow: conf.HTTP.BatchWindow.Duration,
+		},
+		snapshot: func() []broadcastPayload {
+			return packAll(cache.snapshotAll(), conf.HTTP.packOptions(), logger)
+		},
+		history: history,
+		greeting: func() []byte {
+			return serversGreeting(connectors, logger)
+		},
+		pack: conf.HTTP.packOptions(),
+	}, wg, logger)
+	reloads := make(chan reloadRequest)
+	srvs := initAndStartHTTP(conf.HTTP, started, connectors, cache, wspool, brokers, reloads, logger)
 	go wspool.run()
 
+	co := newCoalescer(conf.Coalesce.Words, conf.Coalesce.Interval.Duration)
+
+	// sinks get every message as it arrives.  The pool is a sink too, but
+	// gets messages only once they have been through the coalescer, as
+	// only clients need sparing repeats.
+	var sinks []Sink
+	if rec != nil {
+		sinks = append(sinks, rec)
+	}
+	for _, b := range brokers {
+		sinks = append(sinks, b)
+	}
+	sendTo := func(s Sink, data serverMessage) {
+		if err := s.Publish(data); err != nil {
+			logger.Errorf("%s\n", err)
+		}
+	}
+
+	// reload reloads the config, restarting any servers that changed.
+	// The running config is left alone if the new one is invalid.
+	reload := func() (d serverDiff, err error) {
+		if readsStdin(confPaths) {
+			return d, errStdinReload
+		}
+		newConf, err := loadConfig(confPaths)
+		if err != nil {
+			return
+		}
+		if d = diffServers(conf.Servers, newConf.Servers); d.empty() {
+			return
+		}
+		applyServerDiff(ctx, d, newConf, connectors, resCh, wg, logger)
+		for _, name := range d.Removed {
+			cache.forget(name)
+			hist.forget(name)
+		}
+		conf.Servers = newConf.Servers
+		return
+	}
+
+	// done is closed once every goroutine has finished shutting down, and
+	// stuck fires if that takes longer than the shutdown timeout.
+	done := make(chan struct{})
+	var stuck <-chan time.Time
+	shuttingDown := false
+
+	// startup fires when, if RequireInitialConnection is set, some server
+	// must have connected, as must every required server.
+	var startup <-chan time.Time
+	if conf.RequireInitialConnection || conf.requiresServer() {
+		startup = time.After(conf.StartupTimeout.Duration)
+	}
+
+	// drained fires when the drain period, if any, is over.
+	var drained <-chan time.Time
+	draining := false
+
+	shutdown := func() {
+		shuttingDown = true
+		drained = nil
+		cancel()
+		close(wspool.broadcast)
+		rec.stop()
+		stuck = time.After(conf.ShutdownTimeout.Duration)
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+	}
+
 	for {
 		select {
 		case data := <-resCh:
-			fmt.Println(data.String())
-			wspool.broadcast <- []byte(data.String())
-		case <-sigs:
-			killConnectors(connectors)
-			close(wspool.broadcast)
-			wg.Wait()
-			logger.Println("Exiting...")
+			// Keep draining messages while shutting down, so connectors
+			// don't block, but the pool is gone by then.
+			if shuttingDown {
+				break
+			}
+			if conf.EchoMessages {
+				logger.Infof("%s\n", data.String())
+			} else {
+				logger.Debugf("%s\n", data.String())
+			}
+			for _, s := range sinks {
+				sendTo(s, data)
+			}
+			cache.update(data)
+			hist.add(data)
+			if co.offer(data, time.Now()) {
+				sendTo(wspool, data)
+			}
+		case key := <-co.flushes():
+			if data, ok := co.flush(key, time.Now()); ok && !shuttingDown {
+				sendTo(wspool, data)
+			}
+		case <-hups:
+			if shuttingDown || draining {
+				break
+			}
+			rec.reopen()
+			if d, err := reload(); err != nil {
+				logger.Warnf("not reloading config: %s\n", err)
+			} else if d.empty() {
+				logger.Warnf("servers unchanged, not reloading config\n")
+			}
+		case rq := <-reloads:
+			if shuttingDown || draining {
+				rq.resCh <- reloadResult{err: errShuttingDown}
+				break
+			}
+			d, err := reload()
+			rq.resCh <- reloadResult{diff: d, err: err}
+		case sig := <-sigs:
+			if shuttingDown {
+				logger.Warnf("received %s again, exiting immediately\n", sig)
+				os.Exit(1)
+			}
+			if draining {
+				logger.Infof("received %s again, shutting down without waiting\n", sig)
+				shutdown()
+				break
+			}
+			logger.Infof("received %s, shutting down\n", sig)
+
+			// Shut HTTP down alongside everything else, so that a
+			// second signal is still heard while requests finish.
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				shutdownHTTP(srvs, logger)
+			}()
+			if d := conf.HTTP.DrainTimeout.Duration; 0 < d {
+				logger.Infof("serving existing clients for %s\n", d)
+				draining = true
+				close(wspool.drain)
+				drained = time.After(d)
+				break
+			}
+			shutdown()
+		case <-startup:
+			startup = nil
+			checkRequiredServers(conf.Servers, connectors, conf.StartupTimeout.Duration, logger)
+			if conf.RequireInitialConnection {
+				checkInitialConnection(connectors, conf.StartupTimeout.Duration, logger)
+			}
+		case f := <-failures:
+			if c, ok := connectors.get(f.name); ok && !c.getStatus().everConnected {
+				logger.Fatalf("required server %s (%s) failed to connect: %s\n", f.name, c.conn.hostport, f.err)
+			}
+		case <-drained:
+			logger.Infof("drain period over\n")
+			shutdown()
+		case <-done:
+			logger.Infof("Exiting...\n")
 			os.Exit(0)
+		case <-stuck:
+			logger.Errorf("shutdown took over %s, exiting anyway; still running:\n%s\n", conf.ShutdownTimeout.Duration, goroutineStacks())
+			os.Exit(1)
 		}
 	}
 }
 
-func initAndStartHTTP(conf httpServer, connectors []*bfConnector, wspool *Wspool, logger *log.Logger) {
-	mux := initHTTP(connectors, wspool, logger)
-	go func() {
-		err := http.ListenAndServe(conf.Hostport, mux)
+// checkInitialConnection exits heimdallr, listing the servers that failed,
+// if none of connectors has ever connected within timeout of starting.
+func checkInitialConnection(connectors *connectorSet, timeout time.Duration, logger *leveledLogger) {
+	all := connectors.all()
+	for _, c := range all {
+		if c.getStatus().everConnected {
+			return
+		}
+	}
+	for _, c := range all {
+		logger.Errorf("server %s (%s) failed to connect\n", c.name, c.conn.hostport)
+	}
+	logger.Fatalf("no server connected within %s, giving up\n", timeout)
+}
+
+// checkRequiredServers exits heimdallr, listing the servers that failed, if
+// any required server in servers has never connected within timeout of
+// starting.
+func checkRequiredServers(servers map[string]server, connectors *connectorSet, timeout time.Duration, logger *leveledLogger) {
+	failed := false
+	for _, name := range sortedKeys(servers) {
+		if !servers[name].Required {
+			continue
+		}
+		if c, ok := connectors.get(name); ok && !c.getStatus().everConnected {
+			logger.Errorf("required server %s (%s) failed to connect\n", name, c.conn.hostport)
+			failed = true
+		}
+	}
+	if failed {
+		logger.Fatalf("required servers didn't connect within %s, giving up\n", timeout)
+	}
+}
+
+// goroutineStacks returns the stack traces of every running goroutine, to
+// show what a stuck shutdown is waiting for.
+func goroutineStacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// packAll packs each message in msgs into a broadcast payload, skipping (and
+// logging) any that fail to pack.
+func packAll(msgs []serverMessage, opts packOptions, logger *leveledLogger) (payloads []broadcastPayload) {
+	for _, m := range msgs {
+		payload, err := packPayload(m, opts)
 		if err != nil {
-			logger.Println(err)
+			logger.Errorf("%s\n", err)
+			continue
 		}
-	}()
+		payloads = append(payloads, payload)
+	}
+	return
+}
+
+// packPayload packs m into a broadcast payload, in opts.format and, for
+// clients that negotiate a format of their own, in every other format.
+func packPayload(m serverMessage, opts packOptions) (p broadcastPayload, err error) {
+	p = broadcastPayload{server: m.server, word: m.word()}
+	if p.payload, err = m.pack(opts); err != nil {
+		return
+	}
+
+	p.byFormat = map[string][]byte{opts.format: p.payload}
+	for _, format := range subprotocolFormats {
+		if _, ok := p.byFormat[format]; ok {
+			continue
+		}
+		o := opts
+		o.format = format
+		if p.byFormat[format], err = m.pack(o); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// httpShutdownTimeout is how long in-flight HTTP requests get to finish
+// when heimdallr shuts down.
+const httpShutdownTimeout = 5 * time.Second
+
+// initAndStartHTTP starts an HTTP server for each configured listener.
+func initAndStartHTTP(conf httpServer, started time.Time, connectors *connectorSet, cache *stateCache, wspool *Wspool, brokers []*brokerSink, reloads chan<- reloadRequest, logger *leveledLogger) (srvs []*http.Server) {
+	for name, l := range conf.listeners() {
+		srv := &http.Server{
+			Addr:    l.Hostport,
+			Handler: initHTTP(conf, l, started, connectors, cache, wspool, brokers, reloads, logger),
+		}
+		srv.RegisterOnShutdown(wspool.endStreams)
+		go serveHTTP(name, l, srv, logger)
+		srvs = append(srvs, srv)
+	}
+	return
+}
+
+// serveHTTP runs srv, the server for listener l, until it is shut down.
+func serveHTTP(name string, l listener, srv *http.Server, logger *leveledLogger) {
+	var err error
+	if l.useTLS() {
+		logger.Infof("listener %s: listening for https on %s\n", name, l.Hostport)
+		err = srv.ListenAndServeTLS(l.CertFile, l.KeyFile)
+	} else {
+		logger.Infof("listener %s: listening for http on %s\n", name, l.Hostport)
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		logger.Errorf("listener %s: %s\n", name, err)
+	}
+}
+
+// shutdownHTTP stops each server in srvs accepting requests, and waits up to
+// httpShutdownTimeout for in-flight ones to finish.
+//
+// Websocket connections are hijacked, so the servers don't track them; they
+// are closed by the pool instead.  /stream responses are ended as soon as
+// shutdown starts (see Wspool.endStreams).
+func shutdownHTTP(srvs []*http.Server, logger *leveledLogger) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	for _, srv := range srvs {
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Errorf("%s\n", err)
+		}
+	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLogger returns a logger discarding everything, so that tests only show
+// their own output.
+func testLogger() *leveledLogger {
+	return newLeveledLogger(io.Discard, levelError)
+}
+
+// startTestPool creates, and runs, a pool configured from conf as main would
+// configure it, with no snapshot or history.  The pool is shut down when the
+// test ends.
+func startTestPool(t *testing.T, conf httpServer) *Wspool {
+	t.Helper()
+	return runTestPool(t, testPoolConfig(conf))
+}
+
+// testPoolConfig configures a pool from conf as main would, but with no
+// snapshot or history.
+func testPoolConfig(conf httpServer) wspoolConfig {
+	return wspoolConfig{
+		sendBuffer:     conf.SendBuffer,
+		maxConnections: conf.MaxConnections,
+		maxDrops:       conf.MaxDrops,
+		dropGrace:      conf.DropGrace.Duration,
+		timeouts: wsTimeouts{
+			writeWait:   conf.WriteWait.Duration,
+			pongWait:    conf.PongWait.Duration,
+			pingPeriod:  conf.PingPeriod.Duration,
+			heartbeat:   conf.Heartbeat.Duration,
+			batchWindow: conf.BatchWindow.Duration,
+		},
+		pack: conf.packOptions(),
+	}
+}
+
+// runTestPool creates, and runs, a pool with the given config, shutting it
+// down when the test ends.
+func runTestPool(t *testing.T, config wspoolConfig) *Wspool {
+	t.Helper()
+	wspool := NewWspool(config, new(sync.WaitGroup), testLogger())
+	go wspool.run()
+	t.Cleanup(func() {
+		stopTestPool(wspool)
+	})
+	return wspool
+}
+
+// stopTestPool shuts down a pool started by startTestPool, if it hasn't
+// been already, and waits for it to stop.
+func stopTestPool(wspool *Wspool) {
+	select {
+	case <-wspool.stopped:
+	default:
+		close(wspool.broadcast)
+		<-wspool.stopped
+	}
+}
+
+// waitFor polls cond until it holds, failing the test if it doesn't within a
+// few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// connectionsOf lists the connections in wspool, failing the test if the
+// pool has stopped.
+func connectionsOf(t *testing.T, wspool *Wspool) []connectionInfo {
+	t.Helper()
+	conns, ok := wspool.connectionList()
+	if !ok {
+		t.Fatal("pool has stopped")
+	}
+	return conns
+}
+
+// waitForConnections waits until the pool has n connections registered.
+func waitForConnections(t *testing.T, wspool *Wspool, n int) {
+	t.Helper()
+	waitFor(t, "connections to register", func() bool {
+		return len(connectionsOf(t, wspool)) == n
+	})
+}
+
+// equalStrings returns whether a and b hold the same strings, in the same
+// order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/UniversityRadioYork/baps3-go"
+)
+
+// Events synthesised by heimdallr itself, rather than sent by a server.
+const (
+	evConnected    = "connected"
+	evDisconnected = "disconnected"
+
+	// evServers lists the servers, for new clients (see serversEvent).
+	evServers = "servers"
+
+	// evNotify carries a notification from an operator (see notifyEvent).
+	evNotify = "notify"
+
+	// evClients and evCapacity report websocket clients coming and going,
+	// and the pool filling up or emptying out, to clients asking for meta
+	// events (see clientsEvent and capacityEvent).
+	evClients  = "clients"
+	evCapacity = "capacity"
+
+	// evAck tells a client the response to a command it sent with an id
+	// (see wsAck).
+	evAck = "ack"
+)
+
+// serverMessage is a message from an upstream server, tagged with the name
+// of the connector that received it.
+type serverMessage struct {
+	server string
+	msg    baps3.Message
+
+	// event, if non-empty, makes this a synthetic event about the server
+	// (such as evConnected), in which case msg is unused.
+	event string
+
+	// alias, if non-empty, replaces the word of msg when it is sent to
+	// clients (see server.Rename).
+	alias string
+
+	// received is when heimdallr read msg from the server, or zero for
+	// events.
+	received time.Time
+}
+
+// String returns a human-readable form of m, for logging.
+func (m serverMessage) String() string {
+	if m.event != "" {
+		return m.server + " " + m.event
+	}
+	return m.line()
+}
+
+// word returns the word of m's message, as sent to clients, or "" if m is an
+// event.
+func (m serverMessage) word() string {
+	if m.event != "" {
+		return ""
+	}
+	if m.alias != "" {
+		return m.alias
+	}
+	return m.msg.Word().String()
+}
+
+// line returns m's message as a Bifrost line, as sent to clients.
+func (m serverMessage) line() string {
+	line := m.msg.String()
+	if m.alias == "" {
+		return line
+	}
+	return m.alias + strings.TrimPrefix(line, m.msg.Word().String())
+}
+
+// toJSON returns m's message as a jsonMessage, as sent to clients.
+func (m serverMessage) toJSON() jsonMessage {
+	j := toJSONMessage(m.msg)
+	if m.alias != "" {
+		j.Word = m.alias
+	}
+	return j
+}
+
+// parseCommand parses line, a Bifrost command such as `load "/a file"`, into
+// a message.
+func parseCommand(line string) (*baps3.Message, error) {
+	lines, err := baps3.NewTokeniser().Tokenise([]byte(line + "\n"))
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) != 1 || len(lines[0]) == 0 {
+		return nil, fmt.Errorf("%q is not one command", line)
+	}
+	return baps3.LineToMessage(lines[0])
+}
+
+// Message formats, as in httpServer.Format.
+const (
+	// formatRaw sends messages as Bifrost lines.
+	formatRaw = "raw"
+	// formatJSON sends messages as jsonMessages.
+	formatJSON = "json"
+)
+
+// jsonMessage is the JSON form of a baps3.Message.
+type jsonMessage struct {
+	Word string   `json:"word"`
+	Args []string `json:"args"`
+
+	// Received, if set, is when heimdallr received the message, in
+	// RFC 3339 form with nanoseconds; only bare messages carry it here.
+	Received string `json:"received,omitempty"`
+}
+
+// toJSONMessage converts msg to a jsonMessage.
+func toJSONMessage(msg baps3.Message) jsonMessage {
+	args := msg.Args()
+	if args == nil {
+		// Clients would rather see [] than null.
+		args = []string{}
+	}
+	return jsonMessage{Word: msg.Word().String(), Args: args}
+}
+
+// packOptions controls how serverMessages are packed for clients.
+type packOptions struct {
+	// bare, if true, sends messages without a JSON envelope.
+	bare bool
+	// format is the format of each message: formatRaw or formatJSON.
+	format string
+	// serverSep, if not empty, prefixes bare raw messages with the name of
+	// their server and then serverSep.
+	serverSep string
+	// timestamps, if true, includes when each message was received in
+	// JSON envelopes and bare JSON messages.  Bare raw messages have no
+	// room for it.
+	timestamps bool
+}
+
+// envelope is the JSON structure broadcast to clients for each server
+// message, unless bare messages are requested.
+// Message is a string or jsonMessage, depending on the message format.
+type envelope struct {
+	Server   string      `json:"server"`
+	Message  interface{} `json:"message,omitempty"`
+	Event    string      `json:"event,omitempty"`
+	Received string      `json:"received,omitempty"`
+}
+
+// pack converts m into the payload broadcast to clients.
+// If opts.bare is true, this is just the message, in opts.format (a raw
+// message being the Bifrost line heimdallr used to send, optionally prefixed
+// with the server name and opts.serverSep); otherwise, it is a JSON envelope
+// naming the originating server.
+//
+// Synthetic events are always JSON envelopes, such as
+// {"server":"main","event":"disconnected"}, as bare messages have no way of
+// expressing them.  No Bifrost line starts with "{", so raw clients can still
+// tell them apart.
+func (m serverMessage) pack(opts packOptions) ([]byte, error) {
+	if m.event != "" {
+		return json.Marshal(envelope{Server: m.server, Event: m.event})
+	}
+
+	if opts.bare {
+		if opts.format == formatJSON {
+			j := m.toJSON()
+			j.Received = m.timestamp(opts)
+			return json.Marshal(j)
+		}
+		if opts.serverSep != "" {
+			return []byte(m.server + opts.serverSep + m.line()), nil
+		}
+		return []byte(m.line()), nil
+	}
+
+	e := envelope{Server: m.server, Received: m.timestamp(opts)}
+	if opts.format == formatJSON {
+		e.Message = m.toJSON()
+	} else {
+		e.Message = m.line()
+	}
+	return json.Marshal(e)
+}
+
+// timestamp returns when m was received, as sent to clients, or "" if opts
+// doesn't ask for timestamps or m has none.
+func (m serverMessage) timestamp(opts packOptions) string {
+	if !opts.timestamps || m.received.IsZero() {
+		return ""
+	}
+	return m.received.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/UniversityRadioYork/baps3-go"
+)
+
+// TestPack checks how messages are packed for clients in each combination of
+// options.
+func TestPack(t *testing.T) {
+	received := time.Date(2016, 1, 2, 3, 4, 5, 6, time.UTC)
+	state := serverMessage{server: "main", msg: *baps3.NewMessage(baps3.RsState).AddArg("Playing"), received: received}
+	eof := serverMessage{server: "main", msg: *baps3.NewMessage(baps3.RsEOF)}
+	track := serverMessage{server: "main", msg: *baps3.NewMessage(baps3.RsFile).AddArg("/a.mp3"), alias: "TRACK"}
+	connected := serverMessage{server: "main", event: evConnected}
+
+	tests := []struct {
+		name string
+		m    serverMessage
+		opts packOptions
+		want string
+	}{
+		{"bare raw", state, packOptions{bare: true, format: formatRaw}, `STATE Playing`},
+		{"bare raw, with separator", state, packOptions{bare: true, format: formatRaw, serverSep: ": "}, `main: STATE Playing`},
+		{"bare json", state, packOptions{bare: true, format: formatJSON}, `{"word":"STATE","args":["Playing"]}`},
+		{"bare json, no args", eof, packOptions{bare: true, format: formatJSON}, `{"word":"EOF","args":[]}`},
+		{"bare json, timestamped", state, packOptions{bare: true, format: formatJSON, timestamps: true}, `{"word":"STATE","args":["Playing"],"received":"2016-01-02T03:04:05.000000006Z"}`},
+		{"envelope raw", state, packOptions{format: formatRaw}, `{"server":"main","message":"STATE Playing"}`},
+		{"envelope raw ignores separator", state, packOptions{format: formatRaw, serverSep: ": "}, `{"server":"main","message":"STATE Playing"}`},
+		{"envelope json", state, packOptions{format: formatJSON}, `{"server":"main","message":{"word":"STATE","args":["Playing"]}}`},
+		{"envelope json, no args", eof, packOptions{format: formatJSON}, `{"server":"main","message":{"word":"EOF","args":[]}}`},
+		{"envelope, timestamped", state, packOptions{format: formatRaw, timestamps: true}, `{"server":"main","message":"STATE Playing","received":"2016-01-02T03:04:05.000000006Z"}`},
+		{"timestamps need a receive time", eof, packOptions{format: formatRaw, timestamps: true}, `{"server":"main","message":"EOF"}`},
+		{"alias, bare raw", track, packOptions{bare: true, format: formatRaw}, `TRACK /a.mp3`},
+		{"alias, bare json", track, packOptions{bare: true, format: formatJSON}, `{"word":"TRACK","args":["/a.mp3"]}`},
+		{"alias, envelope json", track, packOptions{format: formatJSON}, `{"server":"main","message":{"word":"TRACK","args":["/a.mp3"]}}`},
+		{"event, bare", connected, packOptions{bare: true, format: formatRaw}, `{"server":"main","event":"connected"}`},
+		{"event, envelope", connected, packOptions{format: formatJSON}, `{"server":"main","event":"connected"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.m.pack(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestToJSONMessage checks that messages convert to JSON with their words and
+// arguments, and with [] rather than null for no arguments.
+func TestToJSONMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      *baps3.Message
+		wantWord string
+		wantArgs []string
+	}{
+		{"no args", baps3.NewMessage(baps3.RsEOF), "EOF", []string{}},
+		{"one arg", baps3.NewMessage(baps3.RsState).AddArg("Playing"), "STATE", []string{"Playing"}},
+		{"several args", baps3.NewMessage(baps3.RsOhai).AddArg("bifrost").AddArg("1.0"), "OHAI", []string{"bifrost", "1.0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := toJSONMessage(*tt.msg)
+			if j.Word != tt.wantWord {
+				t.Errorf("got word %q, want %q", j.Word, tt.wantWord)
+			}
+			if j.Args == nil {
+				t.Error("got nil args, which would be null")
+			}
+			if !reflect.DeepEqual(j.Args, tt.wantArgs) {
+				t.Errorf("got args %q, want %q", j.Args, tt.wantArgs)
+			}
+		})
+	}
+}
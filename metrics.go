@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// poolMetrics counts how a Wspool's clients are keeping up.
+// The pool updates these, and /metrics reads them, so they must be accessed
+// atomically.
+type poolMetrics struct {
+	// dropped is the number of messages any client has missed.
+	dropped uint64
+	// slowDisconnects is the number of clients disconnected for being too
+	// slow.
+	slowDisconnects uint64
+	// writeTimeouts is the number of clients disconnected because a write
+	// to them passed its deadline.
+	writeTimeouts uint64
+	// falling is the number of clients currently missing messages.
+	falling int64
+
+	// queueCounts counts the samples of client queue occupancy falling in
+	// each of queueBuckets, not cumulatively; queueSamples counts every
+	// sample, and queueSum adds them up, in millionths of a full queue.
+	queueCounts  [len(queueBuckets)]uint64
+	queueSamples uint64
+	queueSum     uint64
+}
+
+// queueBuckets are the upper bounds of the buckets of the client queue
+// occupancy histogram, as fractions of a full queue.
+var queueBuckets = [...]float64{0.1, 0.25, 0.5, 0.75, 0.9, 1}
+
+// sampleQueue records that a client's queue held n of its capacity frames.
+func (m *poolMetrics) sampleQueue(n, capacity int) {
+	if capacity <= 0 {
+		return
+	}
+	f := float64(n) / float64(capacity)
+	for i, le := range queueBuckets {
+		if f <= le {
+			atomic.AddUint64(&m.queueCounts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&m.queueSamples, 1)
+	atomic.AddUint64(&m.queueSum, uint64(f*1e6))
+}
+
+// metricsHandler creates the handler for /metrics, which reports counters
+// for connectors, websocket clients and message brokers in the Prometheus
+// text format.
+func metricsHandler(connectors *connectorSet, wspool *Wspool, brokers []*brokerSink, log *leveledLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/plain; version=0.0.4")
+		if err := writeMetrics(w, connectors, wspool, brokers); err != nil {
+			log.Errorf("%s\n", err)
+		}
+	}
+}
+
+// writeMetrics writes the metrics for connectors, wspool and brokers to w.
+func writeMetrics(w io.Writer, connectors *connectorSet, wspool *Wspool, brokers []*brokerSink) (err error) {
+	m := &wspool.metrics
+	metric := func(name, kind, help string, value interface{}) {
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+
+	metric("heimdallr_websocket_connections", "gauge", "Websocket clients connected.", wspool.count())
+	metric("heimdallr_websocket_slow_clients", "gauge", "Websocket clients currently missing messages.", atomic.LoadInt64(&m.falling))
+	metric("heimdallr_websocket_dropped_messages_total", "counter", "Messages websocket clients missed for being slow.", atomic.LoadUint64(&m.dropped))
+	metric("heimdallr_websocket_slow_disconnects_total", "counter", "Websocket clients disconnected for being slow.", atomic.LoadUint64(&m.slowDisconnects))
+	metric("heimdallr_websocket_write_timeouts_total", "counter", "Websocket clients disconnected for a write passing its deadline.", atomic.LoadUint64(&m.writeTimeouts))
+	if err = writeQueueHistogram(w, m); err != nil {
+		return
+	}
+
+	_, err = fmt.Fprintf(w, "# HELP heimdallr_server_connected Whether heimdallr is connected to each server.\n# TYPE heimdallr_server_connected gauge\n")
+	for _, c := range connectors.all() {
+		if err != nil {
+			return
+		}
+		up := 0
+		if c.getStatus().Connected {
+			up = 1
+		}
+		_, err = fmt.Fprintf(w, "heimdallr_server_connected{server=%q} %d\n", c.name, up)
+	}
+	if err != nil || len(brokers) == 0 {
+		return
+	}
+
+	_, err = fmt.Fprintf(w, "# HELP heimdallr_sink_dropped_messages_total Messages dropped for a message broker falling behind.\n# TYPE heimdallr_sink_dropped_messages_total counter\n")
+	for _, b := range brokers {
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, "heimdallr_sink_dropped_messages_total{sink=%q} %d\n", b.name, atomic.LoadUint64(&b.dropped))
+	}
+	return
+}
+
+// writeQueueHistogram writes the client queue occupancy histogram in m to w.
+func writeQueueHistogram(w io.Writer, m *poolMetrics) error {
+	const name = "heimdallr_websocket_queue_occupancy"
+	if _, err := fmt.Fprintf(w, "# HELP %s How full websocket clients' send queues are, as sampled on each broadcast.\n# TYPE %s histogram\n", name, name); err != nil {
+		return err
+	}
+	var total uint64
+	for i, le := range queueBuckets {
+		total += atomic.LoadUint64(&m.queueCounts[i])
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, le, total); err != nil {
+			return err
+		}
+	}
+	// Every sample is at most 1, so all of them are in the last bucket,
+	// but one may have been taken since it was read.
+	samples := atomic.LoadUint64(&m.queueSamples)
+	if samples < total {
+		samples = total
+	}
+	_, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", name, samples, name, float64(atomic.LoadUint64(&m.queueSum))/1e6, name, samples)
+	return err
+}
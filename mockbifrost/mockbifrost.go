@@ -0,0 +1,198 @@
+// Package mockbifrost provides a fake Bifrost server, which plays a script of
+// messages to whoever connects to it, for exercising heimdallr's connectors
+// without a real server.
+package mockbifrost
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UniversityRadioYork/baps3-go"
+)
+
+// Step is one step of a script.  Exactly one of its fields should be set.
+type Step struct {
+	// Msg is a message to send.
+	Msg *baps3.Message
+	// Raw is a line to send as is, for sending malformed lines.  It must
+	// include its own newline, if it is to have one.
+	Raw string
+	// Delay is how long to wait before the next step.
+	Delay time.Duration
+	// Drop, if true, hangs up on the client.
+	Drop bool
+}
+
+// Send returns a step sending msg.
+func Send(msg *baps3.Message) Step {
+	return Step{Msg: msg}
+}
+
+// SendRaw returns a step sending line as is.
+func SendRaw(line string) Step {
+	return Step{Raw: line}
+}
+
+// Wait returns a step waiting for d.
+func Wait(d time.Duration) Step {
+	return Step{Delay: d}
+}
+
+// Drop returns a step hanging up on the client.
+func Drop() Step {
+	return Step{Drop: true}
+}
+
+// Server is a fake Bifrost server.
+//
+// It serves one client at a time, playing its script to each in turn: the
+// script carries on where it left off, so a script with a Drop step, then
+// another OHAI, tests reconnecting.  Once the script runs out, the client
+// stays connected, hearing nothing more, until it or the server hangs up.
+type Server struct {
+	ln     net.Listener
+	script []Step
+
+	lock     sync.Mutex
+	next     int
+	received []string
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewServer starts a server, listening for TCP connections on addr, playing
+// script.  An addr of "127.0.0.1:0" picks a free port, which Addr reports.
+func NewServer(addr string, script []Step) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:     ln,
+		script: script,
+		quit:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the host:port the server is listening on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Received returns every line clients have sent the server so far, without
+// newlines.
+func (s *Server) Received() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+// Close stops the server, hanging up on any client, and waits for it to
+// finish.  It must be called only once.
+func (s *Server) Close() error {
+	close(s.quit)
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+// accept serves each client that connects, one at a time, until the
+// listener is closed.
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.serve(conn)
+	}
+}
+
+// serve plays the rest of the script to the client on conn, then waits for
+// either end to hang up.
+func (s *Server) serve(conn net.Conn) {
+	// Close errors don't matter here.
+	defer func() { _ = conn.Close() }()
+
+	hungUp := make(chan struct{})
+	go s.read(conn, hungUp)
+
+	for {
+		step, ok := s.step()
+		if !ok {
+			break
+		}
+		switch {
+		case step.Drop:
+			return
+		case 0 < step.Delay:
+			select {
+			case <-time.After(step.Delay):
+			case <-hungUp:
+				return
+			case <-s.quit:
+				return
+			}
+		default:
+			if !write(conn, step) {
+				return
+			}
+		}
+	}
+
+	select {
+	case <-hungUp:
+	case <-s.quit:
+	}
+}
+
+// step takes the next step of the script, returning false if there are none
+// left.
+func (s *Server) step() (Step, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.script) <= s.next {
+		return Step{}, false
+	}
+	s.next++
+	return s.script[s.next-1], true
+}
+
+// write sends the message or line in step to conn, returning false if that
+// fails.
+func write(conn net.Conn, step Step) bool {
+	data := []byte(step.Raw)
+	if step.Msg != nil {
+		var err error
+		if data, err = step.Msg.Pack(); err != nil {
+			return false
+		}
+	}
+	_, err := conn.Write(data)
+	return err == nil
+}
+
+// read records each line the client on conn sends, closing hungUp once the
+// client hangs up.
+func (s *Server) read(conn net.Conn, hungUp chan<- struct{}) {
+	defer close(hungUp)
+
+	buf := bufio.NewReader(conn)
+	for {
+		line, err := buf.ReadString('\n')
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.received = append(s.received, strings.TrimSuffix(line, "\n"))
+		s.lock.Unlock()
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// natsDefaultPort is the port NATS servers listen on unless told otherwise.
+const natsDefaultPort = "4222"
+
+// natsProtocol publishes to NATS, using its text protocol, on subjects like
+// prefix.server.WORD, or prefix.server.event for connection events.
+type natsProtocol struct {
+	prefix string
+	// user and pass, if user is set, are sent to log in.
+	user, pass string
+}
+
+// newNATSSink creates, and starts, a sink publishing to NATS as configured by
+// conf, which has already been validated.  It runs until ctx is cancelled.
+func newNATSSink(ctx context.Context, conf natsConfig, rc reconnectConfig, wg *sync.WaitGroup, logger *leveledLogger) *brokerSink {
+	// validate has already parsed this.
+	addr, user, pass, _ := parseNATSURL(conf.URL)
+	proto := natsProtocol{prefix: conf.SubjectPrefix, user: user, pass: pass}
+	return newBrokerSink(ctx, "nats", addr, proto, conf.Queue, rc, wg, logger)
+}
+
+// parseNATSURL splits raw, a nats://[user:pass@]host[:port] URL, into the
+// address to dial and the credentials to log in with, if any.
+func parseNATSURL(raw string) (addr, user, pass string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "nats" {
+		return "", "", "", fmt.Errorf("%q is not a nats:// URL", raw)
+	}
+	if u.Hostname() == "" {
+		return "", "", "", fmt.Errorf("%q has no host", raw)
+	}
+	port := u.Port()
+	if port == "" {
+		port = natsDefaultPort
+	}
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	return net.JoinHostPort(u.Hostname(), port), user, pass, nil
+}
+
+// topic returns the subject to publish m on.
+func (p natsProtocol) topic(m serverMessage) string {
+	last := m.event
+	if last == "" {
+		last = m.msg.Word().String()
+	}
+	return p.prefix + "." + topicToken(m.server) + "." + topicToken(last)
+}
+
+// natsConnect is the body of the CONNECT sent to log in.
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+}
+
+// handshake waits for the server's INFO, then logs in.
+func (p natsProtocol) handshake(c *brokerConn, r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("expected INFO, got %q", strings.TrimSpace(line))
+	}
+
+	j, err := json.Marshal(natsConnect{Name: "heimdallr", User: p.user, Pass: p.pass})
+	if err != nil {
+		return err
+	}
+	return c.write(func(w *bufio.Writer) error {
+		_, err := fmt.Fprintf(w, "CONNECT %s\r\n", j)
+		return err
+	})
+}
+
+// publish writes msg as a PUB.
+func (p natsProtocol) publish(w *bufio.Writer, msg brokerMessage) error {
+	if _, err := fmt.Fprintf(w, "PUB %s %d\r\n", msg.topic, len(msg.payload)); err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.payload); err != nil {
+		return err
+	}
+	_, err := w.WriteString("\r\n")
+	return err
+}
+
+// reply answers the server's PINGs, and gives up on the connection after an
+// -ERR, which, for anything we send, is fatal.
+func (p natsProtocol) reply(c *brokerConn, line string) error {
+	switch {
+	case line == "PING":
+		return c.write(func(w *bufio.Writer) error {
+			_, err := w.WriteString("PONG\r\n")
+			return err
+		})
+	case strings.HasPrefix(line, "-ERR"):
+		return fmt.Errorf("server said %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+	}
+	// INFO updates, +OK and PONG need nothing doing.
+	return nil
+}
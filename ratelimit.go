@@ -0,0 +1,63 @@
+package main
+
+import "time"
+
+// tokenBucket is a token-bucket rate limiter: it holds up to burst tokens,
+// refilled at rate tokens per second, and each allowed event takes one.
+//
+// A nil *tokenBucket allows everything.  tokenBuckets aren't safe for
+// concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full tokenBucket with the given rate and burst,
+// or nil if rate isn't positive (disabling the limit).
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow returns whether an event at now is within the limit, taking a token
+// if so.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.burst < b.tokens {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait returns how long after now until allow would next succeed, and at
+// least a millisecond, so callers can sleep on it.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	need := 1 - b.tokens - now.Sub(b.last).Seconds()*b.rate
+	d := time.Duration(need / b.rate * float64(time.Second))
+	if d < time.Millisecond {
+		return time.Millisecond
+	}
+	return d
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordFlushPeriod is how often a recorder flushes its file.
+const recordFlushPeriod = time.Second
+
+// recordSep separates the fields of each recorded line.
+const recordSep = "\t"
+
+// recorder appends every message heimdallr receives to a file, one per line,
+// as the time it was received (in RFC 3339 form), the server, and the packed
+// Bifrost line, separated by tabs.
+//
+// Writing happens in the recorder's own goroutine, so recording never blocks
+// the caller: if the recorder falls behind, messages are dropped instead.
+// A nil *recorder records nothing.
+type recorder struct {
+	path string
+
+	// allow, if not nil, is the set of the only words recorded, and deny
+	// the set of words never recorded.
+	allow, deny map[string]bool
+
+	lines    chan string
+	reopenCh chan struct{}
+
+	// dropping is true while messages are being dropped.  Only the
+	// caller of record touches it.
+	dropping bool
+
+	wg     *sync.WaitGroup
+	logger *leveledLogger
+}
+
+// newRecorder opens the file at path, for appending, and starts a recorder
+// on it, recording only the words in allow (if not empty) and none of those
+// in deny.  If path is "", it returns nil, which records nothing.
+func newRecorder(path string, allow, deny []string, wg *sync.WaitGroup, logger *leveledLogger) (*recorder, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := openRecordFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &recorder{
+		path:     path,
+		deny:     wordSet(deny),
+		lines:    make(chan string, 1024),
+		reopenCh: make(chan struct{}, 1),
+		wg:       wg,
+		logger:   logger,
+	}
+	if len(allow) != 0 {
+		r.allow = wordSet(allow)
+	}
+	wg.Add(1)
+	go r.run(f)
+	return r, nil
+}
+
+// openRecordFile opens the file at path for appending, creating it if need
+// be.
+func openRecordFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// record records m, received at now, if its word is being recorded.  Events
+// aren't recorded.
+func (r *recorder) record(m serverMessage, now time.Time) {
+	if r == nil || m.event != "" {
+		return
+	}
+	if !wordPermitted(m.msg.Word().String(), r.allow, r.deny) {
+		return
+	}
+
+	// Packing, unlike String, quotes arguments, so lines can be parsed
+	// back.
+	packed, err := m.msg.Pack()
+	if err != nil {
+		r.logger.Errorf("recorder: %s\n", err)
+		return
+	}
+	line := now.Format(time.RFC3339Nano) + recordSep + m.server + recordSep + strings.TrimSuffix(string(packed), "\n")
+	select {
+	case r.lines <- line:
+		r.dropping = false
+	default:
+		if !r.dropping {
+			r.logger.Warnf("recorder: falling behind, dropping messages\n")
+		}
+		r.dropping = true
+	}
+}
+
+// Publish records m as of when it was received, as a Sink.
+func (r *recorder) Publish(m serverMessage) error {
+	at := m.received
+	if at.IsZero() {
+		at = time.Now()
+	}
+	r.record(m, at)
+	return nil
+}
+
+// reopen makes the recorder close and reopen its file, for example after
+// logrotate has moved it away.
+func (r *recorder) reopen() {
+	if r == nil {
+		return
+	}
+	select {
+	case r.reopenCh <- struct{}{}:
+	default:
+		// A reopen is already pending.
+	}
+}
+
+// stop makes the recorder write out everything recorded so far, then close
+// its file.  Nothing may be recorded afterwards.
+func (r *recorder) stop() {
+	if r == nil {
+		return
+	}
+	close(r.lines)
+}
+
+// run is the main loop of a recorder, writing to f.
+func (r *recorder) run(f *os.File) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(recordFlushPeriod)
+	defer ticker.Stop()
+
+	w := bufio.NewWriter(f)
+	for {
+		select {
+		case line, ok := <-r.lines:
+			if !ok {
+				r.flush(w)
+				r.close(f)
+				return
+			}
+			// Errors stick to w, and are reported on flushing.
+			_, _ = w.WriteString(line + "\n")
+		case <-ticker.C:
+			r.flush(w)
+		case <-r.reopenCh:
+			r.flush(w)
+			nf, err := openRecordFile(r.path)
+			if err != nil {
+				r.logger.Errorf("recorder: can't reopen %s, keeping old file: %s\n", r.path, err)
+				break
+			}
+			r.close(f)
+			f = nf
+			w.Reset(f)
+			r.logger.Infof("recorder: reopened %s\n", r.path)
+		}
+	}
+}
+
+// flush flushes w, logging any error.
+func (r *recorder) flush(w *bufio.Writer) {
+	if err := w.Flush(); err != nil {
+		r.logger.Errorf("recorder: writing %s: %s\n", r.path, err)
+	}
+}
+
+// close closes f, logging any error, which may be a write lost on the way
+// to disk.
+func (r *recorder) close(f *os.File) {
+	if err := f.Close(); err != nil {
+		r.logger.Errorf("recorder: closing %s: %s\n", r.path, err)
+	}
+}
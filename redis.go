@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// redisProtocol publishes to Redis pub/sub, using RESP, on a channel for each
+// server, like prefix:server.
+type redisProtocol struct {
+	prefix string
+	// password, if set, is sent to log in.
+	password string
+}
+
+// newRedisSink creates, and starts, a sink publishing to Redis as configured
+// by conf, which has already been validated.  It runs until ctx is
+// cancelled.
+func newRedisSink(ctx context.Context, conf redisConfig, rc reconnectConfig, wg *sync.WaitGroup, logger *leveledLogger) *brokerSink {
+	proto := redisProtocol{prefix: conf.ChannelPrefix, password: conf.Password}
+	return newBrokerSink(ctx, "redis", conf.Addr, proto, conf.Queue, rc, wg, logger)
+}
+
+// topic returns the channel to publish m on.
+func (p redisProtocol) topic(m serverMessage) string {
+	return p.prefix + ":" + topicToken(m.server)
+}
+
+// handshake logs in, if there is a password, and waits for Redis to accept
+// it.
+func (p redisProtocol) handshake(c *brokerConn, r *bufio.Reader) error {
+	if p.password == "" {
+		return nil
+	}
+	if err := c.write(func(w *bufio.Writer) error {
+		return writeRESP(w, "AUTH", p.password)
+	}); err != nil {
+		return err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line = strings.TrimRight(line, "\r\n"); line != "+OK" {
+		return fmt.Errorf("logging in: %s", strings.TrimPrefix(line, "-"))
+	}
+	return nil
+}
+
+// publish writes msg as a PUBLISH.
+func (p redisProtocol) publish(w *bufio.Writer, msg brokerMessage) error {
+	return writeRESP(w, "PUBLISH", msg.topic, string(msg.payload))
+}
+
+// reply gives up on the connection after an error; the other replies, the
+// subscriber counts from each PUBLISH, need nothing doing.
+func (p redisProtocol) reply(c *brokerConn, line string) error {
+	if strings.HasPrefix(line, "-") {
+		return fmt.Errorf("server said %s", strings.TrimPrefix(line, "-"))
+	}
+	return nil
+}
+
+// writeRESP writes a command and its arguments to w, as a RESP array of bulk
+// strings.
+func writeRESP(w *bufio.Writer, args ...string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, a := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// serverDiff describes how the servers in two configs differ.
+// A server whose config changed appears in both lists, as it is restarted.
+type serverDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// reloadRequest asks the main loop to reload the config, as on SIGHUP, and
+// send the outcome on resCh.
+type reloadRequest struct {
+	resCh chan<- reloadResult
+}
+
+// reloadResult is the outcome of a reloadRequest: if err is nil, the servers
+// changed as in diff.
+type reloadResult struct {
+	diff serverDiff
+	err  error
+}
+
+// errShuttingDown is the error reloading the config while heimdallr is
+// shutting down.
+var errShuttingDown = errors.New("shutting down")
+
+// errStdinReload is the error reloading a config that was read from stdin,
+// which can't be read again.
+var errStdinReload = errors.New("config was read from stdin, so can't be reloaded")
+
+// diffServers works out which servers need to be started and stopped to get
+// from the servers in old to those in new.
+func diffServers(old, new map[string]server) (d serverDiff) {
+	for name, s := range old {
+		if news, ok := new[name]; !ok || !reflect.DeepEqual(s, news) {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	for name, s := range new {
+		if olds, ok := old[name]; !ok || !reflect.DeepEqual(s, olds) {
+			d.Added = append(d.Added, name)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	return
+}
+
+// empty returns whether d changes nothing.
+func (d serverDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// applyServerDiff stops the connectors d removes, and starts those d adds
+// under ctx, using the server configs in conf.
+func applyServerDiff(ctx context.Context, d serverDiff, conf Config, connectors *connectorSet, resCh chan<- serverMessage, wg *sync.WaitGroup, logger *leveledLogger) {
+	for _, name := range d.Removed {
+		if c := connectors.remove(name); c != nil {
+			logger.Infof("stopping connector %s\n", name)
+			c.stop()
+		}
+	}
+	for _, name := range d.Added {
+		logger.Infof("starting connector %s\n", name)
+		// Startup is long over, so new servers never fail fast.
+		startConnector(ctx, name, conf.Servers[name], conf, connectors, resCh, nil, wg, logger)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/UniversityRadioYork/baps3-go"
+)
+
+// replayPrefix marks a server.Hostport as the path of a file, written by a
+// recorder, to replay instead of connecting to a real server.
+const replayPrefix = "replay://"
+
+// replayPath returns the file a server.Hostport asks to replay, if any.
+func replayPath(hostport string) (path string, ok bool) {
+	if !strings.HasPrefix(hostport, replayPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(hostport, replayPrefix), true
+}
+
+// replayConfig configures how a replay server plays its file back.
+type replayConfig struct {
+	// Speed multiplies the original timing of the messages; 0 means 1.
+	Speed float64
+	// Rate, if positive, replaces the original timing with this many
+	// messages per second.
+	Rate float64
+	// Loop, if true, starts the file again once it runs out.
+	Loop bool
+	// From, if set, replays only the messages recorded from the server of
+	// that name, rather than every message in the file.
+	From string
+}
+
+// gap returns how long to wait between messages recorded at prev and next.
+func (rc replayConfig) gap(prev, next time.Time) time.Duration {
+	if 0 < rc.Rate {
+		return time.Duration(float64(time.Second) / rc.Rate)
+	}
+	if prev.IsZero() || next.Before(prev) {
+		return 0
+	}
+	speed := rc.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	return time.Duration(float64(next.Sub(prev)) / speed)
+}
+
+// recordedMessage is one message parsed back out of a recorded file.
+type recordedMessage struct {
+	at     time.Time
+	server string
+	msg    baps3.Message
+}
+
+// parseRecordedLine parses one line written by a recorder.
+func parseRecordedLine(line string) (rm recordedMessage, err error) {
+	fields := strings.SplitN(line, recordSep, 3)
+	if len(fields) != 3 {
+		return rm, fmt.Errorf("malformed recorded line %q", line)
+	}
+	if rm.at, err = time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+		return
+	}
+	rm.server = fields[1]
+	msg, err := parseCommand(fields[2])
+	if err != nil {
+		return
+	}
+	rm.msg = *msg
+	return
+}
+
+// runReplay plays the file at path back, as if it were a server sending its
+// messages, until the upstream is told to quit.
+// Commands sent to the replay are dropped.  While the file can't be read,
+// the replay retries it with backoff, as if redialling a server.
+func (u *upstream) runReplay(path string) {
+	for {
+		f, err := os.Open(path)
+		if err != nil {
+			u.logger.Warnf("upstream %s: can't replay: %s\n", u.name, err)
+			u.note(fmt.Errorf("can't replay: %s", err))
+			if !u.replayWait(u.backoff.next()) {
+				return
+			}
+			continue
+		}
+		u.backoff.reset()
+
+		// The file is only read, so close errors don't matter.
+		if !u.setStatus(true) {
+			_ = f.Close()
+			return
+		}
+		quit := u.replayFile(f)
+		_ = f.Close()
+		if quit {
+			return
+		}
+
+		if !u.replay.Loop {
+			u.logger.Infof("upstream %s: replay of %s finished\n", u.name, path)
+			// Stay 'connected', with nothing more to say.
+			for u.replayWait(time.Hour) {
+			}
+			return
+		}
+		if !u.setStatus(false) {
+			return
+		}
+	}
+}
+
+// replayFile plays f back, returning true if the upstream was told to quit
+// before it finished.
+func (u *upstream) replayFile(f *os.File) bool {
+	var prev time.Time
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		rm, err := parseRecordedLine(scanner.Text())
+		if err != nil {
+			u.logger.Warnf("upstream %s: %s\n", u.name, err)
+			continue
+		}
+		if u.replay.From != "" && rm.server != u.replay.From {
+			continue
+		}
+
+		if !u.replayWait(u.replay.gap(prev, rm.at)) || !u.forward(upstreamMessage{msg: rm.msg, at: time.Now()}) {
+			return true
+		}
+		prev = rm.at
+	}
+	if err := scanner.Err(); err != nil {
+		u.logger.Warnf("upstream %s: %s\n", u.name, err)
+	}
+	return false
+}
+
+// replayWait waits for d to elapse, dropping any requests that arrive
+// meanwhile, as a replay can't act on them.
+// It returns false if the upstream was told to quit instead.
+func (u *upstream) replayWait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case rq := <-u.ReqCh:
+			u.logger.Debugf("upstream %s: replaying, dropping %s\n", u.name, rq.msg.String())
+			rq.lost()
+		case <-u.reconnectCh:
+			u.logger.Infof("upstream %s: replays can't reconnect, ignoring request\n", u.name)
+		case <-u.done:
+			return false
+		}
+	}
+}
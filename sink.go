@@ -0,0 +1,15 @@
+package main
+
+// Sink is something heimdallr publishes the messages from its servers to,
+// such as the websocket pool or the record file.
+//
+// Publish takes a serverMessage, rather than a server name and a
+// baps3.Message, because a baps3.Message can't carry the connected and
+// disconnected events, or the time a message arrived, and every sink needs
+// those.
+type Sink interface {
+	// Publish publishes m.  It is called from main's loop, so mustn't
+	// block for long: a sink that can fall behind should drop messages,
+	// as the recorder does, rather than hold up every other sink.
+	Publish(m serverMessage) error
+}
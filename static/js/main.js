@@ -1,4 +1,5 @@
-var ws = new WebSocket("ws://" + location.host + "/ws")
+var wsScheme = (location.protocol === "https:") ? "wss://" : "ws://";
+var ws = new WebSocket(wsScheme + location.host + location.pathname.replace(/[^\/]*$/, "") + "ws")
 
 ws.onmessage = function (event) {
     console.log(event.data);
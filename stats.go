@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// statsWindow is the number of seconds over which connectorStats averages
+// message rates.
+const statsWindow = 10
+
+// connectorStats counts the messages passing through a connector.
+// It is updated by the connector and read by HTTP handlers, so is guarded by
+// its own lock.
+type connectorStats struct {
+	lock sync.Mutex
+
+	// connects is how many times the upstream has connected, and
+	// connectedAt when it last did (or zero if it is down).
+	connects    int
+	connectedAt time.Time
+
+	// messages is the number of messages since the upstream connected.
+	messages uint64
+
+	// buckets counts messages in each of the last statsWindow seconds,
+	// indexed by Unix time modulo statsWindow; last is the second of the
+	// newest bucket.
+	buckets [statsWindow]uint64
+	last    int64
+
+	// stalls is how many times the connector has found the update queue
+	// full, over its whole life.
+	stalls uint64
+
+	// denied is how many messages the server's allow and deny lists have
+	// dropped, over the connector's whole life.
+	denied uint64
+
+	// commandsDropped is how many commands from clients have been dropped
+	// because the upstream's queue was full, over the connector's life.
+	commandsDropped uint64
+}
+
+// statsResponse is the body of a /servers/{name}/stats response.
+type statsResponse struct {
+	Name              string  `json:"name"`
+	Connected         bool    `json:"connected"`
+	MessagesPerSecond float64 `json:"messagesPerSecond"`
+	Messages          uint64  `json:"messages"`
+	UptimeSeconds     float64 `json:"uptimeSeconds"`
+	Reconnects        int     `json:"reconnects"`
+	Stalls            uint64  `json:"stalls"`
+	Denied            uint64  `json:"denied"`
+	CommandsDropped   uint64  `json:"commandsDropped"`
+}
+
+// setConnected records the upstream connecting or disconnecting at now.
+// The message counts start afresh with each connection.
+func (s *connectorStats) setConnected(connected bool, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !connected {
+		s.connectedAt = time.Time{}
+		return
+	}
+	s.connects++
+	s.connectedAt = now
+	s.messages = 0
+	s.buckets = [statsWindow]uint64{}
+	s.last = now.Unix()
+}
+
+// record counts a message arriving at now.
+func (s *connectorStats) record(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.advance(now)
+	s.messages++
+	s.buckets[now.Unix()%statsWindow]++
+}
+
+// stall counts the update queue being full, returning the new count.
+func (s *connectorStats) stall() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stalls++
+	return s.stalls
+}
+
+// deny counts a message dropped by the allow and deny lists.
+func (s *connectorStats) deny() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.denied++
+}
+
+// dropCommand counts a command dropped for want of room, returning the new
+// count.
+func (s *connectorStats) dropCommand() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.commandsDropped++
+	return s.commandsDropped
+}
+
+// advance empties any buckets for seconds that have passed, without
+// messages, since the newest one.
+// It must be called with the lock held.
+func (s *connectorStats) advance(now time.Time) {
+	sec := now.Unix()
+	if statsWindow <= sec-s.last {
+		s.buckets = [statsWindow]uint64{}
+	} else {
+		for t := s.last + 1; t <= sec; t++ {
+			s.buckets[t%statsWindow] = 0
+		}
+	}
+	if s.last < sec {
+		s.last = sec
+	}
+}
+
+// snapshot returns the statistics as of now.
+func (s *connectorStats) snapshot(now time.Time) (res statsResponse) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if 0 < s.connects {
+		res.Reconnects = s.connects - 1
+	}
+	res.Messages = s.messages
+	res.Stalls = s.stalls
+	res.Denied = s.denied
+	res.CommandsDropped = s.commandsDropped
+	if s.connectedAt.IsZero() {
+		return
+	}
+	res.Connected = true
+	uptime := now.Sub(s.connectedAt)
+	res.UptimeSeconds = uptime.Seconds()
+
+	s.advance(now)
+	var sum uint64
+	for _, n := range s.buckets {
+		sum += n
+	}
+	// Don't spread a young connection's messages over time it wasn't up.
+	window := time.Duration(statsWindow) * time.Second
+	if uptime < window {
+		window = uptime
+	}
+	if window < time.Second {
+		window = time.Second
+	}
+	res.MessagesPerSecond = float64(sum) / window.Seconds()
+	return
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamHandler creates the handler for /stream, which feeds clients that
+// can't use websockets, such as curl, the same messages over a plain HTTP
+// response, until they go away.
+//
+// Clients asking for text/event-stream get Server-Sent Events; anyone else
+// gets one message per line.  Query parameters stand in for the frames a
+// websocket client would send: server (repeatable) subscribes to servers,
+// only and except (comma-separated) filter words, and format picks "raw" or
+// "json" messages.
+func streamHandler(conf httpServer, connectors *connectorSet, wspool *Wspool, log *leveledLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		if !authorized(r, conf.readToken()) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		c := wspool.newStreamConn(r.RemoteAddr)
+		if err := c.applyQuery(r, connectors); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !wspool.acquire(conf.MaxConnections) {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+			return
+		}
+		// This handler lasts as long as the stream does.
+		defer wspool.release()
+
+		sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+		if sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		// Stop nginx, at least, buffering the stream.
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		if !wspool.add(c) {
+			log.Debugf("stream %s: pool has stopped\n", c.remoteAddr)
+			return
+		}
+		// However the stream ends, the pool forgets it straight away.
+		defer wspool.remove(c)
+
+		var heartbeat <-chan time.Time
+		if 0 < conf.Heartbeat.Duration {
+			ticker := time.NewTicker(conf.Heartbeat.Duration)
+			defer ticker.Stop()
+			heartbeat = ticker.C
+		}
+
+		for {
+			var msg []byte
+			select {
+			case m, ok := <-c.queue:
+				if !ok {
+					// The pool closed the stream; unlike a
+					// websocket, it has no way to tell the
+					// client why.
+					log.Debugf("stream %s: closed by pool: %s\n", c.remoteAddr, c.closeReason)
+					return
+				}
+				msg = m
+			case <-heartbeat:
+				msg = heartbeatFrame
+			case <-r.Context().Done():
+				return
+			case <-wspool.streamsEnded:
+				log.Debugf("stream %s: server shutting down\n", c.remoteAddr)
+				return
+			}
+			if _, err := w.Write(streamFrame(msg, sse)); err != nil {
+				log.Debugf("stream %s: write failed: %s\n", c.remoteAddr, err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// endStreams ends every /stream response, now and to come.  Unlike
+// websockets, streams aren't hijacked, so the HTTP servers' Shutdown waits
+// for them, and needs them ended to finish; they aren't drained.
+func (wspool *Wspool) endStreams() {
+	wspool.endOnce.Do(func() {
+		close(wspool.streamsEnded)
+	})
+}
+
+// streamConn is the consumer a /stream handler serves instead of a websocket.
+type streamConn struct {
+	queue      chan []byte
+	remoteAddr string
+	// format, if not "", is the message format the client asked for,
+	// overriding the default.
+	format string
+
+	// closeReason is why the pool closed queue.  The pool sets it, just
+	// before closing queue.
+	closeReason string
+	closeOnce   sync.Once
+
+	// The query parameters set the subscriptions and word filter once,
+	// before the stream registers.
+	filter
+}
+
+// newStreamConn creates a stream consumer, for registering with the pool,
+// for the client at remoteAddr.
+func (wspool *Wspool) newStreamConn(remoteAddr string) *streamConn {
+	return &streamConn{
+		queue:      make(chan []byte, wspool.config.sendBuffer),
+		remoteAddr: remoteAddr,
+	}
+}
+
+// send queues payload, in the format the client asked for, without blocking.
+func (c *streamConn) send(payload broadcastPayload) bool {
+	select {
+	case c.queue <- payload.in(c.format):
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the queue, ending the stream.  Unlike a websocket, a stream
+// has no way to tell the client the code or reason.
+func (c *streamConn) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeReason = reason
+		close(c.queue)
+	})
+}
+
+// queued returns the number of frames waiting in the queue.
+func (c *streamConn) queued() int {
+	return len(c.queue)
+}
+
+// addr returns the client's address.
+func (c *streamConn) addr() string {
+	return c.remoteAddr
+}
+
+// info describes the stream's address and filters.  Streams can't send
+// commands.
+func (c *streamConn) info() connectionInfo {
+	info := c.describe()
+	info.RemoteAddr = c.remoteAddr
+	return info
+}
+
+// applyQuery sets the stream's subscriptions, filter and format from the
+// query parameters of r, a /stream request.
+func (c *streamConn) applyQuery(r *http.Request, connectors *connectorSet) error {
+	q := r.URL.Query()
+
+	if servers := q["server"]; len(servers) != 0 {
+		c.subs = make(map[string]bool)
+		for _, name := range servers {
+			if _, ok := connectors.get(name); !ok {
+				return fmt.Errorf("unknown server: %s", name)
+			}
+			c.subs[name] = true
+		}
+	}
+	if only := q.Get("only"); only != "" {
+		c.only = wordSet(strings.Split(only, ","))
+	} else if except := q.Get("except"); except != "" {
+		c.except = wordSet(strings.Split(except, ","))
+	}
+
+	switch format := q.Get("format"); format {
+	case "":
+	case formatRaw, formatJSON:
+		c.format = format
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+	return nil
+}
+
+// streamFrame frames msg for a /stream response: as a Server-Sent Event if
+// sse is true, or otherwise as a line.
+// A message with newlines inside it becomes several SSE data lines, which
+// the client joins back up.
+func streamFrame(msg []byte, sse bool) []byte {
+	if !sse {
+		return append(append([]byte(nil), msg...), '\n')
+	}
+	var b bytes.Buffer
+	for _, line := range bytes.Split(msg, []byte("\n")) {
+		b.WriteString("data: ")
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestShutdownEndsStreams checks that shutting the HTTP server down, as main
+// does, ends a /stream response at once, rather than waiting for it until
+// the shutdown times out.
+func TestShutdownEndsStreams(t *testing.T) {
+	conf := defaultConfig().HTTP
+	wspool := startTestPool(t, conf)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: initHTTP(conf, listener{Routes: []string{routeWS}}, time.Now(), newConnectorSet(), nil, wspool, nil, nil, testLogger()),
+	}
+	srv.RegisterOnShutdown(wspool.endStreams)
+	go srv.Serve(ln)
+
+	res, err := http.Get("http://" + ln.Addr().String() + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	waitForConnections(t, wspool, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+	if took := time.Since(start); time.Second < took {
+		t.Errorf("shutdown took %s", took)
+	}
+	waitForConnections(t, wspool, 0)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// throttle limits how many messages a client gets per second, as it asked
+// with maxRate, coalescing the rest: of the messages held back, only the
+// latest with each word from each server is kept, in the order they first
+// arrived.  Events, having no word, are never coalesced, and never wait for
+// the rate, but do wait behind any messages held back before them.
+//
+// Held-back messages are the tail of the client's send queue: anything
+// arriving while some are held back is held back too, and the write loop
+// only takes them once the queue proper is empty, so nothing is reordered.
+// They count towards the queue's size, so a client that can't keep up even
+// with coalescing falls foul of the pool's drop policy like any other.
+//
+// The pool offers it messages, and the client's write loop takes them, so it
+// is guarded by lock.
+type throttle struct {
+	lock sync.Mutex
+	// bucket limits the rate, or is nil if there is no limit.
+	bucket *tokenBucket
+	// size is the most messages the queue, and the throttle, may hold
+	// between them.
+	size int
+
+	// pending holds the messages held back, oldest first.  The first of
+	// them was the head'th ever held back, and index maps the throttleKey
+	// of each message with a word to its number, so its place in pending
+	// is its number less head.
+	pending []broadcastPayload
+	head    int
+	index   map[string]int
+
+	// ready is signalled whenever a message is held back, or the rate
+	// changes, so the write loop knows to come for it.
+	ready chan struct{}
+}
+
+// newThrottle creates a throttle with no limit, for a queue of the given
+// size.
+func newThrottle(size int) *throttle {
+	return &throttle{
+		size:  size,
+		index: make(map[string]int),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// throttleKey is the key under which p is coalesced.
+func throttleKey(p broadcastPayload) string {
+	return p.server + "\x00" + p.word
+}
+
+// setRate limits the throttle to rate messages per second, or, if rate isn't
+// positive, removes the limit.  Messages already held back go at the new
+// rate.  Setting the rate it already has changes nothing, so can't be used to
+// refill the bucket.
+func (t *throttle) setRate(rate float64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if rate <= 0 {
+		rate = 0
+	}
+	if t.rateLocked() == rate {
+		return
+	}
+	t.bucket = newTokenBucket(rate, 1)
+	t.signal()
+}
+
+// rate returns the limit, or 0 if there is none.
+func (t *throttle) rate() float64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.rateLocked()
+}
+
+// rateLocked is rate, for callers already holding lock.
+func (t *throttle) rateLocked() float64 {
+	if t.bucket == nil {
+		return 0
+	}
+	return t.bucket.rate
+}
+
+// len returns the number of messages held back.
+func (t *throttle) len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.pending)
+}
+
+// hold offers p, sent at now, when queued messages are already in the queue
+// proper.  It returns held as false if p may go straight onto the queue, or
+// true if the throttle has dealt with it, in which case ok is false if p was
+// dropped because the queue and throttle are full between them.
+func (t *throttle) hold(p broadcastPayload, now time.Time, queued int) (held, ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// Anything arriving behind held-back messages waits its turn.
+	if len(t.pending) == 0 && (p.word == "" || t.bucket.allow(now)) {
+		return false, true
+	}
+
+	if p.word != "" {
+		if n, found := t.index[throttleKey(p)]; found {
+			t.pending[n-t.head] = p
+			return true, true
+		}
+	}
+	if t.size <= queued+len(t.pending) {
+		return true, false
+	}
+	if p.word != "" {
+		t.index[throttleKey(p)] = t.head + len(t.pending)
+	}
+	t.pending = append(t.pending, p)
+	t.signal()
+	return true, true
+}
+
+// next takes the oldest held-back message, if the rate lets it go at now.
+// Otherwise, it returns false, and how long until one may go, or 0 if none is
+// waiting.
+func (t *throttle) next(now time.Time) (p broadcastPayload, ok bool, wait time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.pending) == 0 {
+		return p, false, 0
+	}
+	p = t.pending[0]
+	if p.word != "" && !t.bucket.allow(now) {
+		return broadcastPayload{}, false, t.bucket.wait(now)
+	}
+
+	t.pending[0] = broadcastPayload{}
+	t.pending = t.pending[1:]
+	t.head++
+	if p.word != "" {
+		delete(t.index, throttleKey(p))
+	}
+	return p, true, 0
+}
+
+// signal wakes the write loop, if it isn't already due to wake.
+// The caller must hold lock.
+func (t *throttle) signal() {
+	select {
+	case t.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// wordPayload returns a payload from server main with the given word and body.
+func wordPayload(w, body string) broadcastPayload {
+	return broadcastPayload{server: "main", word: w, payload: []byte(body)}
+}
+
+// eventPayload returns an event payload with the given body.
+func eventPayload(body string) broadcastPayload {
+	return broadcastPayload{server: "main", payload: []byte(body)}
+}
+
+// takeAll takes every held-back message the throttle lets go at now.
+func takeAll(th *throttle, now time.Time) (bodies []string) {
+	for {
+		p, ok, _ := th.next(now)
+		if !ok {
+			return
+		}
+		bodies = append(bodies, string(p.payload))
+	}
+}
+
+// TestThrottleOrder checks that held-back messages, coalesced or not, and
+// events behind them, come out in the order they first arrived.
+func TestThrottleOrder(t *testing.T) {
+	th := newThrottle(16)
+	th.setRate(1)
+	now := time.Now()
+
+	if held, _ := th.hold(wordPayload("STATE", "STATE Playing"), now, 0); held {
+		t.Fatal("first message held back, despite the bucket being full")
+	}
+	for _, p := range []broadcastPayload{
+		wordPayload("TIME", "TIME 1"),
+		eventPayload("connected"),
+		wordPayload("STATE", "STATE Stopped"),
+		wordPayload("TIME", "TIME 2"),
+	} {
+		if held, ok := th.hold(p, now, 0); !held || !ok {
+			t.Fatalf("%s: got held %v, ok %v; want it held", p.payload, held, ok)
+		}
+	}
+	if n := th.len(); n != 3 {
+		t.Errorf("got %d held back, want 3 after coalescing", n)
+	}
+
+	if got := takeAll(th, now); len(got) != 0 {
+		t.Errorf("got %q before the rate allowed any", got)
+	}
+	// The event waits behind TIME, but then goes without waiting for
+	// the rate itself.
+	if got, want := takeAll(th, now.Add(time.Second)), []string{"TIME 2", "connected"}; !equalStrings(got, want) {
+		t.Errorf("after 1s, got %q, want %q", got, want)
+	}
+	if got, want := takeAll(th, now.Add(2*time.Second)), []string{"STATE Stopped"}; !equalStrings(got, want) {
+		t.Errorf("after 2s, got %q, want %q", got, want)
+	}
+
+	// Nothing is held back now, so events go straight on.
+	if held, _ := th.hold(eventPayload("disconnected"), now.Add(2*time.Second), 0); held {
+		t.Error("event held back with nothing ahead of it")
+	}
+}
+
+// TestThrottleCoalescesAfterTaking checks that coalescing still finds the
+// right place for a message after others have been taken from ahead of it.
+func TestThrottleCoalescesAfterTaking(t *testing.T) {
+	th := newThrottle(64)
+	th.setRate(1)
+	now := time.Now()
+	th.hold(wordPayload("OHAI", "OHAI"), now, 0)
+
+	words := []string{"STATE", "TIME", "FILE", "EOF"}
+	for i := 0; i < 20; i++ {
+		for _, w := range words {
+			th.hold(wordPayload(w, w), now, 0)
+		}
+		now = now.Add(time.Second)
+		p, ok, _ := th.next(now)
+		if !ok {
+			t.Fatalf("round %d: nothing let go", i)
+		}
+		// Taking one word puts it behind the rest, which stay
+		// coalesced.
+		if n := th.len(); n != len(words)-1 {
+			t.Fatalf("round %d: got %d held back after taking %s, want %d", i, n, p.payload, len(words)-1)
+		}
+		th.hold(wordPayload(string(p.payload), "new "+string(p.payload)), now, 0)
+		if n := th.len(); n != len(words) {
+			t.Fatalf("round %d: got %d held back, want %d", i, n, len(words))
+		}
+	}
+}
+
+// TestThrottleCap checks that held-back messages share the queue's size, so
+// the pool sees a full queue once they and the queue fill it.
+func TestThrottleCap(t *testing.T) {
+	th := newThrottle(4)
+	th.setRate(1)
+	now := time.Now()
+	th.hold(wordPayload("OHAI", "OHAI"), now, 0)
+
+	// Two already queued leaves room for two held back.
+	queued := 2
+	for _, w := range []string{"STATE", "TIME"} {
+		if held, ok := th.hold(wordPayload(w, w), now, queued); !held || !ok {
+			t.Fatalf("%s: got held %v, ok %v; want it held", w, held, ok)
+		}
+	}
+	if held, ok := th.hold(wordPayload("FILE", "FILE"), now, queued); !held || ok {
+		t.Errorf("FILE: got held %v, ok %v; want it dropped", held, ok)
+	}
+	if held, ok := th.hold(eventPayload("connected"), now, queued); !held || ok {
+		t.Errorf("event: got held %v, ok %v; want it dropped", held, ok)
+	}
+	// Coalescing takes no more room, so still works when full.
+	if held, ok := th.hold(wordPayload("TIME", "TIME 2"), now, queued); !held || !ok {
+		t.Errorf("TIME: got held %v, ok %v; want it coalesced", held, ok)
+	}
+}
+
+// TestThrottleSetSameRate checks that asking for the rate already set
+// doesn't refill the bucket.
+func TestThrottleSetSameRate(t *testing.T) {
+	th := newThrottle(16)
+	th.setRate(1)
+	now := time.Now()
+	if held, _ := th.hold(wordPayload("STATE", "STATE Playing"), now, 0); held {
+		t.Fatal("first message held back, despite the bucket being full")
+	}
+	th.setRate(1)
+	if held, _ := th.hold(wordPayload("TIME", "TIME 1"), now, 0); !held {
+		t.Error("setting the same rate again refilled the bucket")
+	}
+	if got := th.rate(); got != 1 {
+		t.Errorf("got rate %v, want 1", got)
+	}
+	th.setRate(0)
+	if got := th.rate(); got != 0 {
+		t.Errorf("got rate %v, want 0 after removing the limit", got)
+	}
+	// Lifting the limit lets held-back messages go at once.
+	if got, want := takeAll(th, now), []string{"TIME 1"}; !equalStrings(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestWsConnThrottleQueue checks that a websocket connection counts held-back
+// messages as queued, and reports its queue full once they fill it.
+func TestWsConnThrottleQueue(t *testing.T) {
+	c := &wsConn{queue: make(chan []byte, 3), throttle: newThrottle(3)}
+	c.throttle.setRate(1)
+
+	for _, p := range []broadcastPayload{wordPayload("STATE", "1"), wordPayload("TIME", "2"), wordPayload("FILE", "3")} {
+		if !c.send(p) {
+			t.Fatalf("%s: queue full too soon", p.payload)
+		}
+	}
+	if n := len(c.queue); n != 1 {
+		t.Errorf("got %d in the queue proper, want 1", n)
+	}
+	if n := c.queued(); n != 3 {
+		t.Errorf("got %d queued, want 3", n)
+	}
+	if c.send(wordPayload("EOF", "4")) {
+		t.Error("send succeeded with the queue full")
+	}
+	if !c.send(wordPayload("TIME", "5")) {
+		t.Error("coalescing send failed with the queue full")
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UniversityRadioYork/baps3-go"
+)
+
+// upstream is a connection to a Bifrost server.
+//
+// It plays the same role as baps3.Connector, but does not give up when its
+// connection drops: instead, it redials the server with exponential backoff
+// until the context it runs under is cancelled.
+type upstream struct {
+	name     string
+	hostport string
+	backoff  *backoff
+
+	// timeout bounds both dialling the server and waiting for it to
+	// greet us with OHAI.
+	timeout time.Duration
+
+	// maxLine is the longest line, in bytes, read from the server.
+	maxLine int
+
+	// localAddr, if not nil, is the local address to dial the server from.
+	localAddr net.Addr
+	// keepAlive is the TCP keepalive period, or negative for none.
+	keepAlive time.Duration
+	// remoteAddr is the address the server was last reached at, which can
+	// change between connections if hostport names it by DNS.
+	remoteAddr string
+
+	// connectedAt is when the server last greeted us.
+	connectedAt time.Time
+	// resolve, if not nil, looks up the addresses of a host named in
+	// hostport in place of the system resolver, as tests do to move a
+	// name from one address to another.
+	resolve func(host string) ([]string, error)
+
+	// tlsConfig, if not nil, loads the TLS config to connect to the
+	// server with.
+	tlsConfig func() (*tls.Config, error)
+
+	// hello lists commands to send the server as soon as we connect.
+	hello []baps3.Message
+
+	// replay configures playing back a recorded file, for replay://
+	// servers.
+	replay replayConfig
+
+	// noteError, if not nil, is told of each error that keeps or takes
+	// the upstream off the server, for reporting.  Errors passed to it
+	// never quote messages, which may carry credentials.
+	noteError func(error)
+
+	// reconnectCh, when sent to, makes the upstream hang up on the server,
+	// if connected, and redial it straight away.  It holds one pending
+	// request at most.
+	reconnectCh chan struct{}
+
+	// ReqCh carries commands to send to the server.  Commands arriving
+	// while the server is unreachable are dropped.
+	ReqCh chan command
+	// pending holds the ack of each command sent on the current
+	// connection still awaiting a response, oldest first (see
+	// acknowledge).  Commands nobody is waiting on have nil acks.
+	pending []func(res *baps3.Message)
+	// resCh receives every message the server sends.
+	resCh chan<- upstreamMessage
+	// failFast, if set, is called with the error that made the first
+	// attempt at connecting fail, for required servers that mustn't be
+	// retried on startup.  It is cleared once that attempt is over.
+	failFast func(err error)
+
+	// statusCh receives true whenever the upstream connects, and false
+	// whenever it loses its connection.
+	statusCh chan<- bool
+	// done is the Done channel of the context passed to Run; once it is
+	// closed, the upstream shuts down.
+	done <-chan struct{}
+
+	wg     *sync.WaitGroup
+	logger *leveledLogger
+}
+
+// Run dials the server, serves the connection until it drops, and repeats,
+// until ctx is cancelled.
+// Replay servers play their file back instead.
+func (u *upstream) Run(ctx context.Context) {
+	defer u.wg.Done()
+	u.done = ctx.Done()
+
+	if path, ok := replayPath(u.hostport); ok {
+		u.runReplay(path)
+		return
+	}
+
+	for {
+		conn, err := u.dial()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				u.logger.Warnf("upstream %s: connecting to %s timed out\n", u.name, u.hostport)
+				u.note(fmt.Errorf("connecting to %s timed out", u.hostport))
+			} else {
+				u.logger.Warnf("upstream %s: connecting to %s failed: %s\n", u.name, u.hostport, err)
+				u.note(fmt.Errorf("connecting to %s failed: %s", u.hostport, err))
+			}
+			if !u.wait(u.backoff.next()) {
+				return
+			}
+			continue
+		}
+		u.noteRemoteAddr(conn.RemoteAddr())
+
+		quit, connected, redial := u.serve(conn)
+		if err := conn.Close(); err != nil {
+			u.logger.Debugf("upstream %s: closing connection: %s\n", u.name, err)
+		}
+		if quit {
+			return
+		}
+
+		if connected {
+			if !u.setStatus(false) {
+				return
+			}
+			if redial {
+				continue
+			}
+			// A connection that lasted was probably lost to a
+			// blip, so is redialled soon; one that keeps dropping
+			// as soon as it is made backs off like any other
+			// failure.
+			if minStableConnection <= time.Since(u.connectedAt) {
+				u.backoff.reset()
+			}
+		}
+		if !u.wait(u.backoff.next()) {
+			return
+		}
+	}
+}
+
+// minStableConnection is how long a connection to a server must last for it
+// to be redialled with the backoff reset once it drops.
+const minStableConnection = 10 * time.Second
+
+// dial opens a connection to the server, over TLS if so configured.
+// Nothing about the last connection is kept, so a host named by DNS is
+// looked up afresh on every attempt, following it if its address moves (as
+// a Kubernetes service's might on failover).
+func (u *upstream) dial() (net.Conn, error) {
+	d := net.Dialer{Timeout: u.timeout, LocalAddr: u.localAddr, KeepAlive: u.keepAlive}
+	network, addr := serverNetwork(u.hostport)
+	host, _, _ := net.SplitHostPort(addr)
+	if network == "tcp" && u.resolve != nil {
+		var err error
+		if addr, err = u.resolveAddr(addr); err != nil {
+			return nil, err
+		}
+	}
+	if u.tlsConfig == nil {
+		return d.Dial(network, addr)
+	}
+
+	conf, err := u.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if conf.ServerName == "" && host != "" {
+		// addr may have been resolved, so would give the wrong
+		// server name.
+		conf = conf.Clone()
+		conf.ServerName = host
+	}
+	// The timeout covers the TLS handshake too.
+	return tls.DialWithDialer(&d, network, addr, conf)
+}
+
+// resolveAddr looks up the host in addr, a host:port, with resolve, returning
+// the first address found with the port.  IP addresses are returned as is.
+func (u *upstream) resolveAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(stripZone(host)) != nil {
+		return addr, nil
+	}
+	addrs, err := u.resolve(host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses found for %s", host)
+	}
+	return net.JoinHostPort(addrs[0], port), nil
+}
+
+// noteRemoteAddr records addr, the address the server was just reached at,
+// logging the change if it was last reached somewhere else.
+func (u *upstream) noteRemoteAddr(addr net.Addr) {
+	if addr == nil {
+		return
+	}
+	s := addr.String()
+	if u.remoteAddr != "" && u.remoteAddr != s {
+		u.logger.Infof("upstream %s: %s is now at %s, not %s\n", u.name, u.hostport, s, u.remoteAddr)
+	}
+	u.remoteAddr = s
+}
+
+// unixPrefix marks a server.Hostport as the path of a Unix socket.
+const unixPrefix = "unix://"
+
+// serverNetwork splits hostport, a server.Hostport, into the network and
+// address to dial: a unix:///path/to/socket URL dials the socket, and
+// anything else is a host:port reached over TCP.
+func serverNetwork(hostport string) (network, addr string) {
+	if strings.HasPrefix(hostport, unixPrefix) {
+		return "unix", strings.TrimPrefix(hostport, unixPrefix)
+	}
+	return "tcp", hostport
+}
+
+// reconnect asks the upstream to hang up and redial, returning false if a
+// reconnect is already pending.
+func (u *upstream) reconnect() bool {
+	select {
+	case u.reconnectCh <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// setStatus reports a change in connection status, returning false if the
+// upstream was told to quit instead.
+func (u *upstream) setStatus(connected bool) bool {
+	select {
+	case u.statusCh <- connected:
+		return true
+	case <-u.done:
+		return false
+	}
+}
+
+// wait waits for d to elapse, dropping any requests that arrive meanwhile,
+// or for a request to reconnect, which cuts the wait short.
+// It returns false if the upstream was told to quit instead.
+func (u *upstream) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-u.reconnectCh:
+			u.logger.Infof("upstream %s: redialling %s on request\n", u.name, u.hostport)
+			return true
+		case rq := <-u.ReqCh:
+			u.logger.Warnf("upstream %s: not connected, dropping %s\n", u.name, rq.msg.String())
+			rq.lost()
+		case <-u.done:
+			return false
+		}
+	}
+}
+
+// serve waits for the server on conn to greet us, then shuttles messages
+// between conn and the upstream's channels until conn fails or the upstream
+// is told to quit.
+// It returns whether the upstream was told to quit, whether the server got
+// as far as greeting us (and so was reported as connected), and whether it
+// hung up because it was asked to reconnect, and so should redial at once.
+func (u *upstream) serve(conn net.Conn) (quit, connected, redial bool) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	msgCh := make(chan upstreamMessage)
+	errCh := make(chan error, 1)
+	go u.readLoop(conn, msgCh, errCh, stop)
+	// Responses to anything sent on this connection won't come on the
+	// next.
+	defer u.abandonPending()
+
+	if !u.sendHello(conn) {
+		return false, false, false
+	}
+	if quit, connected = u.handshake(msgCh, errCh); quit || !connected {
+		return
+	}
+
+	for {
+		select {
+		case msg := <-msgCh:
+			u.acknowledge(msg.msg)
+			if !u.forward(msg) {
+				return true, true, false
+			}
+		case err := <-errCh:
+			u.readFailed(err)
+			return false, true, false
+		case <-u.reconnectCh:
+			u.logger.Infof("upstream %s: reconnecting to %s on request\n", u.name, u.hostport)
+			return false, true, true
+		case rq := <-u.ReqCh:
+			packed, err := rq.msg.Pack()
+			if err != nil {
+				u.logger.Errorf("upstream %s: %s\n", u.name, err)
+				rq.lost()
+				break
+			}
+			if _, err := conn.Write(packed); err != nil {
+				u.logger.Warnf("upstream %s: %s\n", u.name, err)
+				u.note(err)
+				rq.lost()
+				return false, true, false
+			}
+			u.expect(rq.ack)
+		case <-u.done:
+			return true, true, false
+		}
+	}
+}
+
+// sendHello sends the server on conn each of the on-connect commands,
+// returning false if that fails.
+func (u *upstream) sendHello(conn net.Conn) bool {
+	for _, msg := range u.hello {
+		packed, err := msg.Pack()
+		if err != nil {
+			u.logger.Errorf("upstream %s: %s\n", u.name, err)
+			continue
+		}
+		if _, err := conn.Write(packed); err != nil {
+			u.logger.Warnf("upstream %s: %s\n", u.name, err)
+			u.note(err)
+			return false
+		}
+		// Nobody is waiting on the response, but it still takes its
+		// turn.
+		u.expect(nil)
+		u.logger.Infof("upstream %s: sent on-connect command %s\n", u.name, msg.String())
+	}
+	return true
+}
+
+// handshake waits up to the timeout for the server to send OHAI, which
+// tells us it really is a Bifrost server, and reports the connection if so.
+// It returns whether the upstream was told to quit, and whether the
+// handshake succeeded.
+func (u *upstream) handshake(msgCh <-chan upstreamMessage, errCh <-chan error) (quit, ok bool) {
+	timer := time.NewTimer(u.timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-msgCh:
+		if word := msg.msg.Word().String(); word != "OHAI" {
+			u.logger.Warnf("upstream %s: expected OHAI, got %s\n", u.name, word)
+			u.note(fmt.Errorf("expected OHAI, got %s", word))
+			return false, false
+		}
+		u.connectedAt = time.Now()
+		u.failFast = nil
+		if !u.setStatus(true) || !u.forward(msg) {
+			return true, true
+		}
+		return false, true
+	case err := <-errCh:
+		u.readFailed(err)
+		return false, false
+	case <-timer.C:
+		u.logger.Warnf("upstream %s: timed out waiting for OHAI\n", u.name)
+		u.note(errors.New("timed out waiting for OHAI"))
+		return false, false
+	case <-u.done:
+		return true, false
+	}
+}
+
+// readFailed logs, and notes, err, which ended reading from the server.
+// The server hanging up is routine, so isn't worth a warning.
+func (u *upstream) readFailed(err error) {
+	if err == io.EOF {
+		u.logger.Infof("upstream %s: server closed the connection\n", u.name)
+		u.note(errors.New("server closed the connection"))
+		return
+	}
+	if err == errLineTooLong {
+		u.logger.Warnf("upstream %s: server sent a line over %d bytes, hanging up\n", u.name, u.maxLine)
+		u.note(fmt.Errorf("server sent a line over %d bytes", u.maxLine))
+		return
+	}
+	u.logger.Warnf("upstream %s: %s\n", u.name, err)
+	u.note(err)
+}
+
+// note passes err to noteError, if set, and, if the first attempt at
+// connecting has just failed, to failFast.
+func (u *upstream) note(err error) {
+	if u.noteError != nil {
+		u.noteError(err)
+	}
+	if u.failFast != nil {
+		u.failFast(err)
+		u.failFast = nil
+	}
+}
+
+// command is a message to send to the server, from a client.
+type command struct {
+	msg baps3.Message
+	// ack, if not nil, is called with the server's response to msg, or
+	// with nil if none is coming, because msg was dropped or the
+	// connection was lost first.  It is called from the upstream's
+	// goroutine, so mustn't block.
+	ack func(res *baps3.Message)
+}
+
+// lost tells whoever sent c that no response is coming.
+func (c command) lost() {
+	if c.ack != nil {
+		c.ack(nil)
+	}
+}
+
+// maxPending is the most commands awaiting a response remembered for each
+// connection.  Past that, the server probably isn't responding to some of
+// them, and the oldest is given up on.
+const maxPending = 256
+
+// expect records that a command with the given ack was just sent, for
+// acknowledge to match with its response.
+func (u *upstream) expect(ack func(res *baps3.Message)) {
+	if maxPending <= len(u.pending) {
+		if old := u.pending[0]; old != nil {
+			old(nil)
+		}
+		u.pending = u.pending[1:]
+	}
+	u.pending = append(u.pending, ack)
+}
+
+// acknowledge passes msg, if it is a response (OK, WHAT or FAIL), to the ack
+// of the oldest command still awaiting one.
+//
+// Bifrost has no request ids, so this relies on the server answering every
+// command, in the order it was sent, with exactly one response.  A server
+// that ignores a command, or sends a response nobody asked for, puts every
+// later match one out; this lasts until the connection drops and pending
+// is cleared, or, for ignored commands, until maxPending covers the gap.
+func (u *upstream) acknowledge(msg baps3.Message) {
+	switch msg.Word() {
+	case baps3.RsOk, baps3.RsWhat, baps3.RsFail:
+	default:
+		return
+	}
+	if len(u.pending) == 0 {
+		return
+	}
+	ack := u.pending[0]
+	u.pending = u.pending[1:]
+	if ack != nil {
+		ack(&msg)
+	}
+}
+
+// abandonPending tells every command still awaiting a response that none is
+// coming.
+func (u *upstream) abandonPending() {
+	for _, ack := range u.pending {
+		if ack != nil {
+			ack(nil)
+		}
+	}
+	u.pending = nil
+}
+
+// upstreamMessage is a message from the server, with the time it was read.
+type upstreamMessage struct {
+	msg baps3.Message
+	at  time.Time
+}
+
+// forward passes msg on to resCh, returning false if the upstream was told
+// to quit instead.
+func (u *upstream) forward(msg upstreamMessage) bool {
+	select {
+	case u.resCh <- msg:
+		return true
+	case <-u.done:
+		return false
+	}
+}
+
+// readLoop reads and tokenises messages from conn onto msgCh, until reading
+// fails (reporting the error to errCh) or stop is closed.
+func (u *upstream) readLoop(conn net.Conn, msgCh chan<- upstreamMessage, errCh chan<- error, stop <-chan struct{}) {
+	// Both of these must outlive each read: the reader may hold bytes
+	// past the newline it stopped at, and the tokeniser may hold a
+	// partial line if a newline turns up inside a quoted word.
+	buf := bufio.NewReader(conn)
+	tok := baps3.NewTokeniser()
+
+	for {
+		data, err := readLine(buf, u.maxLine)
+		// Timestamp the messages as soon as they are read, before
+		// tokenising them, for measuring latency.
+		at := time.Now()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		lines, err := tok.Tokenise(data)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		for _, line := range lines {
+			msg, err := baps3.LineToMessage(line)
+			if err != nil {
+				u.logger.Warnf("upstream %s: %s\n", u.name, err)
+				continue
+			}
+			select {
+			case msgCh <- upstreamMessage{msg: *msg, at: at}:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// errLineTooLong is reported when a server sends a line longer than the
+// upstream's limit.
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads from buf up to and including the next newline, like
+// ReadBytes, but gives up with errLineTooLong once it has read more than max
+// bytes without finding one.
+func readLine(buf *bufio.Reader, max int) (line []byte, err error) {
+	for {
+		chunk, err := buf.ReadSlice('\n')
+		// ReadSlice's result is only valid until the next read.
+		line = append(line, chunk...)
+		if max < len(line) {
+			return nil, errLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readAll runs u's read loop on a connection fed data in chunks of the given
+// size, returning each message read, as its word and arguments, and the
+// error that ended reading.
+func readAll(t *testing.T, u *upstream, data string, chunk int) (lines []string, err error) {
+	t.Helper()
+	server, client := net.Pipe()
+	defer client.Close()
+
+	msgCh := make(chan upstreamMessage)
+	errCh := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go u.readLoop(client, msgCh, errCh, stop)
+
+	go func() {
+		for i := 0; i < len(data); i += chunk {
+			end := i + chunk
+			if len(data) < end {
+				end = len(data)
+			}
+			if _, err := server.Write([]byte(data[i:end])); err != nil {
+				return
+			}
+		}
+		server.Close()
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-msgCh:
+			lines = append(lines, strings.Join(append([]string{msg.msg.Word().String()}, msg.msg.Args()...), "|"))
+		case err := <-errCh:
+			return lines, err
+		case <-timeout:
+			t.Fatal("read loop never finished")
+		}
+	}
+}
+
+// TestReadLoopChunks checks that messages split across reads at any point,
+// even inside quoted words, or with a newline inside a quoted word, come out
+// whole, with nothing lost or merged.
+func TestReadLoopChunks(t *testing.T) {
+	data := "OHAI 'playd 1.0'\nSTATE Playing\nFILE \"/music/a \\\"song\\\".mp3\"\nFILE 'two\nlines'\nTIME 1234\n"
+	want := []string{"OHAI|playd 1.0", "STATE|Playing", `FILE|/music/a "song".mp3`, "FILE|two\nlines", "TIME|1234"}
+
+	for chunk := 1; chunk <= len(data); chunk++ {
+		u := &upstream{name: "test", maxLine: defaultMaxLineLength, logger: testLogger()}
+		got, _ := readAll(t, u, data, chunk)
+		if !equalStrings(got, want) {
+			t.Errorf("in chunks of %d: got %q, want %q", chunk, got, want)
+		}
+	}
+}
+
+// TestRunBacksOffFlappingServer checks that a server that greets us, then
+// hangs up at once, every time, is redialled with backoff, not in a tight
+// loop.
+func TestRunBacksOffFlappingServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted int64
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&accepted, 1)
+			conn.Write([]byte("OHAI flapper\n"))
+			conn.Close()
+		}
+	}()
+
+	statusCh := make(chan bool)
+	resCh := make(chan upstreamMessage)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := new(sync.WaitGroup)
+	u := &upstream{
+		name:        "flapper",
+		hostport:    ln.Addr().String(),
+		backoff:     &backoff{base: 50 * time.Millisecond, max: 50 * time.Millisecond},
+		timeout:     time.Second,
+		maxLine:     defaultMaxLineLength,
+		ReqCh:       make(chan command),
+		reconnectCh: make(chan struct{}, 1),
+		resCh:       resCh,
+		statusCh:    statusCh,
+		wg:          wg,
+		logger:      testLogger(),
+	}
+	wg.Add(1)
+	go u.Run(ctx)
+	go func() {
+		for {
+			select {
+			case <-statusCh:
+			case <-resCh:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	const period = 500 * time.Millisecond
+	time.Sleep(period)
+	cancel()
+	wg.Wait()
+
+	// Delays average half the cap, so expect about 20 connections; a
+	// tight loop makes thousands.
+	if n := atomic.LoadInt64(&accepted); n < 2 || 60 < n {
+		t.Errorf("got %d connections in %s, want about %d", n, period, period/(25*time.Millisecond))
+	}
+}
+
+// TestReadLoopMultiLine checks that several lines arriving in one read come
+// out as one message each, every line exactly once, with no earlier line
+// repeated in a later one.
+func TestReadLoopMultiLine(t *testing.T) {
+	data := "STATE Playing\nTIME 1\nTIME 2\nFILE /a.mp3\n"
+	want := []string{"STATE|Playing", "TIME|1", "TIME|2", "FILE|/a.mp3"}
+
+	u := &upstream{name: "test", maxLine: defaultMaxLineLength, logger: testLogger()}
+	got, _ := readAll(t, u, data, len(data))
+	if !equalStrings(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestReadLoopLongLine checks that a server sending a line over the limit,
+// never ending it, is given up on as soon as the limit is passed, rather
+// than buffered without bound.
+func TestReadLoopLongLine(t *testing.T) {
+	const max = 1024
+	data := "OHAI mock\n" + strings.Repeat("x", 1<<20)
+
+	u := &upstream{name: "test", maxLine: max, logger: testLogger()}
+	got, err := readAll(t, u, data, 4096)
+	if err != errLineTooLong {
+		t.Errorf("got error %v, want errLineTooLong", err)
+	}
+	if want := []string{"OHAI|mock"}; !equalStrings(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestReadLineLimit checks readLine's limit on lines with and without
+// newlines, around the limit.
+func TestReadLineLimit(t *testing.T) {
+	tests := []struct {
+		data    string
+		wantErr error
+	}{
+		{strings.Repeat("x", 15) + "\n", nil},
+		{strings.Repeat("x", 16) + "\n", errLineTooLong},
+		{strings.Repeat("x", 100), errLineTooLong},
+		{strings.Repeat("x", 10), io.EOF},
+	}
+	for _, tt := range tests {
+		// A buffer smaller than the limit makes readLine piece the
+		// line together from several reads.
+		buf := bufio.NewReaderSize(strings.NewReader(tt.data), 16)
+		line, err := readLine(buf, 16)
+		if err != tt.wantErr {
+			t.Errorf("%d bytes: got error %v, want %v", len(tt.data), err, tt.wantErr)
+		}
+		if err == nil && string(line) != tt.data {
+			t.Errorf("%d bytes: got %q, want it all", len(tt.data), line)
+		}
+	}
+}
+
+// TestDialResolvesAfresh checks that each dial looks the server's name up
+// again, following it when its address moves, as on a failover.
+func TestDialResolvesAfresh(t *testing.T) {
+	first, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	_, port, _ := net.SplitHostPort(first.Addr().String())
+	// Linux answers on all of 127/8, so the same port is likely free on
+	// another loopback address.
+	second, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", port))
+	if err != nil {
+		t.Skipf("can't listen on a second loopback address: %s", err)
+	}
+	defer second.Close()
+	for _, ln := range []net.Listener{first, second} {
+		go func(ln net.Listener) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}(ln)
+	}
+
+	var lookups []string
+	current := "127.0.0.1"
+	u := &upstream{
+		name:     "moving",
+		hostport: net.JoinHostPort("bifrost.test", port),
+		timeout:  time.Second,
+		resolve: func(host string) ([]string, error) {
+			lookups = append(lookups, host)
+			return []string{current}, nil
+		},
+		logger: testLogger(),
+	}
+
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.2"} {
+		current = ip
+		conn, err := u.dial()
+		if err != nil {
+			t.Fatalf("dialling with %s at %s: %s", u.hostport, ip, err)
+		}
+		u.noteRemoteAddr(conn.RemoteAddr())
+		conn.Close()
+		if want := net.JoinHostPort(ip, port); u.remoteAddr != want {
+			t.Errorf("reached %s, want %s", u.remoteAddr, want)
+		}
+	}
+	if want := []string{"bifrost.test", "bifrost.test", "bifrost.test"}; !equalStrings(lookups, want) {
+		t.Errorf("got lookups %q, want one per dial", lookups)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Build information, set at link time with, for example:
+//
+//	go build -ldflags "-X main.version=1.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "0.0"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionResponse is the body of a /version response.
+type versionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	uptime
+}
+
+// uptime says how long heimdallr has been running, for /version and /healthz:
+// as a duration such as "26h3m4s", for people, and in seconds, for
+// dashboards.
+type uptime struct {
+	Started       time.Time `json:"started"`
+	Uptime        string    `json:"uptime"`
+	UptimeSeconds int64     `json:"uptimeSeconds"`
+}
+
+// uptimeSince returns the uptime, as of now, of a process started at
+// started.
+func uptimeSince(started, now time.Time) uptime {
+	d := now.Sub(started)
+	return uptime{
+		Started:       started,
+		Uptime:        d.Round(time.Second).String(),
+		UptimeSeconds: int64(d / time.Second),
+	}
+}
+
+// versionString describes this build, for -v.
+func versionString() string {
+	return fmt.Sprintf("heimdallr %s (commit %s, built %s)", version, commit, buildDate)
+}
+
+// versionHandler creates the handler for /version, which describes this
+// build, and how long it has been running since started.
+func versionHandler(started time.Time, log *leveledLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := versionResponse{
+			Version:   version,
+			Commit:    commit,
+			BuildDate: buildDate,
+			uptime:    uptimeSince(started, time.Now()),
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		if err := dumpJSON(w, res); err != nil {
+			log.Errorf("%s\n", err)
+		}
+	}
+}
@@ -1,41 +1,262 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/UniversityRadioYork/baps3-go"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// newUpgrader creates the upgrader for websocket connections on a listener,
+// configured from conf.
+// Each listener gets its own, so that no state is shared between them.
+func newUpgrader(conf httpServer) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin:       originChecker(conf.AllowedOrigins),
+		EnableCompression: conf.Compression,
+		Subprotocols:      subprotocols(conf.Format),
+		ReadBufferSize:    conf.ReadBufferSize,
+		WriteBufferSize:   conf.WriteBufferSize,
+	}
+}
+
+// originChecker creates a function checking the Origin header of websocket
+// upgrade requests against allowed (see httpServer.AllowedOrigins).
+func originChecker(allowed []string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		// Non-browser clients don't send an Origin, and aren't subject to
+		// the same-origin policy anyway.
+		if origin == "" {
+			return true
+		}
+
+		if len(allowed) == 0 {
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		}
+
+		for _, pattern := range allowed {
+			if matchOrigin(pattern, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// matchOrigin returns whether origin matches pattern, which may contain one
+// "*" wildcard.
+func matchOrigin(pattern, origin string) bool {
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return strings.EqualFold(pattern, origin)
+	}
+
+	prefix, suffix := strings.ToLower(pattern[:i]), strings.ToLower(pattern[i+1:])
+	origin = strings.ToLower(origin)
+	return len(prefix)+len(suffix) <= len(origin) &&
+		strings.HasPrefix(origin, prefix) &&
+		strings.HasSuffix(origin, suffix)
+}
+
+// broadcastPayload is a payload to broadcast to every connection subscribed
+// to the server it came from.
+type broadcastPayload struct {
+	server string
+	// word is the word of the message in payload, or "" if it is an
+	// event.
+	word    string
+	payload []byte
+
+	// byFormat, if not nil, holds the payload packed in each message
+	// format, for connections that negotiated one.
+	byFormat map[string][]byte
+
+	// match, if not nil, picks the consumers that get the payload; the
+	// rest never see it.  It is called from the pool's goroutine.
+	match func(consumer) bool
+}
+
+// in returns the payload in format, or in the default format if format is ""
+// or unavailable.
+func (p broadcastPayload) in(format string) []byte {
+	if b, ok := p.byFormat[format]; ok {
+		return b
+	}
+	return p.payload
+}
+
+// subprotocolFormats maps the websocket subprotocols clients may ask for to
+// the message formats they select.
+var subprotocolFormats = map[string]string{
+	"bifrost-raw":  formatRaw,
+	"bifrost-json": formatJSON,
+}
+
+// subprotocols lists the keys of subprotocolFormats, preferring the one
+// selecting defaultFormat when clients offer more than one.
+func subprotocols(defaultFormat string) (protos []string) {
+	for _, proto := range sortedKeys(subprotocolFormats) {
+		if subprotocolFormats[proto] == defaultFormat {
+			protos = append([]string{proto}, protos...)
+		} else {
+			protos = append(protos, proto)
+		}
+	}
+	return
+}
+
+// wspoolConfig holds the tunables of a Wspool.
+type wspoolConfig struct {
+	// sendBuffer is the number of messages queued for each connection.
+	sendBuffer int
+	// maxDrops is the number of consecutive messages a connection may
+	// miss, because its queue is full, before it is disconnected.
+	maxDrops int
+	// dropGrace, if positive, also disconnects a connection whose queue
+	// has stayed full for this long, however few messages it has missed.
+	dropGrace time.Duration
+
+	// timeouts are the timeouts of each connection.
+	timeouts wsTimeouts
+
+	// snapshot, if not nil, returns the payloads that bring a new
+	// connection up to date with the current state of every server.
+	snapshot func() []broadcastPayload
+
+	// history, if not nil, returns the payloads of up to n of the latest
+	// messages from server, or from every server if server is "", oldest
+	// first.
+	history func(server string, n int) []broadcastPayload
+
+	// maxConnections, if positive, is the most connections allowed, as
+	// reported in meta events.
+	maxConnections int
+
+	// greeting, if not nil, returns a frame sent to each new connection
+	// before its snapshot, such as the list of servers.
+	greeting func() []byte
+
+	// pack is how messages published to the pool are packed.
+	pack packOptions
 }
 
 // Wspool is the structure of pools of websocket connections.
 type Wspool struct {
-	broadcast            chan []byte
-	register, unregister chan *wsConn
-	connections          map[*wsConn]bool
-	quit                 bool
-	wg                   *sync.WaitGroup
+	// active counts connections, including those still being upgraded.
+	// Unlike connections, it is read and written by HTTP handlers, and
+	// must be accessed atomically.
+	active int64
+	// metrics, too, are read by HTTP handlers.
+	metrics poolMetrics
+
+	broadcast            chan broadcastPayload
+	register, unregister chan consumer
+	resync               chan resyncRequest
+	notify               chan notification
+	connections          map[consumer]*connMeta
+
+	// list carries requests for a listing of connections, answered by
+	// the pool itself so as not to race with register and unregister.
+	list chan chan<- []connectionInfo
+
+	// quit is set once the pool is shutting down, and stopped closed once
+	// it has stopped serving its channels.
+	quit    bool
+	stopped chan struct{}
+
+	// drain is closed to stop the pool accepting new connections, each of
+	// which is then closed as soon as it registers.  Broadcasts to
+	// existing connections carry on until broadcast is closed.
+	drain    chan struct{}
+	draining bool
+
+	// streamsEnded is closed, by endStreams, once HTTP shutdown starts,
+	// ending every /stream response.
+	streamsEnded chan struct{}
+	endOnce      sync.Once
+
+	// joined and left count the connections registered and closed since
+	// meta events last reported them, and full is whether the pool was
+	// last reported full.
+	joined, left int
+	full         bool
+
+	config wspoolConfig
+	wg     *sync.WaitGroup
+	logger *leveledLogger
 }
 
-// NewWspool creates a Wspool with the given waitgroup.
-func NewWspool(wg *sync.WaitGroup) (wspool *Wspool) {
+// NewWspool creates a Wspool with the given config, waitgroup and logger.
+func NewWspool(config wspoolConfig, wg *sync.WaitGroup, logger *leveledLogger) (wspool *Wspool) {
 	wspool = &Wspool{
-		broadcast:   make(chan []byte),
-		register:    make(chan *wsConn),
-		unregister:  make(chan *wsConn),
-		connections: make(map[*wsConn]bool),
-		wg:          wg,
+		broadcast:    make(chan broadcastPayload),
+		register:     make(chan consumer),
+		unregister:   make(chan consumer),
+		resync:       make(chan resyncRequest),
+		notify:       make(chan notification),
+		list:         make(chan chan<- []connectionInfo),
+		drain:        make(chan struct{}),
+		stopped:      make(chan struct{}),
+		connections:  make(map[consumer]*connMeta),
+		streamsEnded: make(chan struct{}),
+		config:       config,
+		wg:           wg,
+		logger:       logger,
 	}
 	return
 }
 
-func (wspool *Wspool) closeConn(conn *wsConn) {
+// acquire reserves a place in the pool for a new connection, returning false
+// if the pool already has max connections (and max is positive).
+// Each successful acquire must be paired with a release.
+func (wspool *Wspool) acquire(max int) bool {
+	for {
+		n := atomic.LoadInt64(&wspool.active)
+		if 0 < max && int64(max) <= n {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&wspool.active, n, n+1) {
+			return true
+		}
+	}
+}
+
+// release gives up a place reserved by acquire.
+func (wspool *Wspool) release() {
+	atomic.AddInt64(&wspool.active, -1)
+}
+
+// count returns the number of connections in, or joining, the pool.
+func (wspool *Wspool) count() int64 {
+	return atomic.LoadInt64(&wspool.active)
+}
+
+// newConn wraps ws in a wsConn suitable for registering with this pool.
+func (wspool *Wspool) newConn(ws *websocket.Conn) *wsConn {
+	return newWsConn(ws, wspool.config.sendBuffer, wspool.config.timeouts)
+}
+
+// closeConn removes conn from the pool, and makes it hang up with the given
+// close code and reason.
+func (wspool *Wspool) closeConn(conn consumer, code int, reason string) {
+	if meta := wspool.connections[conn]; 0 < meta.streak {
+		atomic.AddInt64(&wspool.metrics.falling, -1)
+	}
 	delete(wspool.connections, conn)
-	close(conn.send)
+	wspool.left++
+	conn.close(code, reason)
 }
 
 // run is the main loop on a Wspool.
@@ -46,84 +267,1075 @@ func (wspool *Wspool) run() {
 		case payload, ok := <-wspool.broadcast:
 			wspool.handleBroadcast(payload, ok)
 		case conn := <-wspool.register:
-			wspool.connections[conn] = true
+			if wspool.draining {
+				conn.close(websocket.CloseGoingAway, "server shutting down")
+				break
+			}
+			wspool.connections[conn] = &connMeta{since: time.Now()}
+			wspool.joined++
+			wspool.replay(conn)
+		case <-wspool.drain:
+			wspool.logger.Infof("draining %d websocket connection(s)\n", len(wspool.connections))
+			wspool.draining = true
+			// drain is closed, so stop selecting on it.
+			wspool.drain = nil
 		case conn := <-wspool.unregister:
 			if _, ok := wspool.connections[conn]; ok {
-				wspool.closeConn(conn)
+				wspool.closeConn(conn, websocket.CloseNormalClosure, "")
+			}
+		case resCh := <-wspool.list:
+			resCh <- wspool.listConnections()
+		case n := <-wspool.notify:
+			n.resCh <- wspool.fanOut(n.payload)
+		case rq := <-wspool.resync:
+			if _, ok := wspool.connections[rq.conn]; !ok {
+				break
+			}
+			if 0 < rq.history {
+				wspool.replayHistory(rq.conn, rq.server, rq.history)
+			} else {
+				wspool.replayServer(rq.conn, rq.server)
 			}
 		}
 		if wspool.quit {
+			close(wspool.stopped)
 			wspool.wg.Done()
 			break
 		}
+		wspool.announceClients()
+	}
+}
+
+// clientsEvent is the meta event reporting connections coming and going.
+type clientsEvent struct {
+	Event string `json:"event"`
+	// Clients is the number of connections, and MaxClients the most
+	// allowed (or 0 if unlimited).
+	Clients    int `json:"clients"`
+	MaxClients int `json:"maxClients"`
+	// Joined and Left count the connections opened and closed since the
+	// last clientsEvent.
+	Joined int `json:"joined"`
+	Left   int `json:"left"`
+}
+
+// capacityEvent is the meta event reporting the pool filling up, so that it
+// refuses new connections, or having room again.
+type capacityEvent struct {
+	Event      string `json:"event"`
+	Full       bool   `json:"full"`
+	Clients    int    `json:"clients"`
+	MaxClients int    `json:"maxClients"`
+}
+
+// announceClients sends a clientsEvent, and a capacityEvent if the pool has
+// filled up or found room, to connections wanting meta events, if any
+// connections have come or gone since the last time.
+// Changes are gathered up per turn of the pool's loop, so that fanning the
+// events out, which may close slow connections, never happens while the
+// pool is in the middle of closing one.
+func (wspool *Wspool) announceClients() {
+	if wspool.joined == 0 && wspool.left == 0 {
+		return
+	}
+	n, max := len(wspool.connections), wspool.config.maxConnections
+	ev := clientsEvent{Event: evClients, Clients: n, MaxClients: max, Joined: wspool.joined, Left: wspool.left}
+	wspool.joined, wspool.left = 0, 0
+	wspool.sendMeta(ev)
+
+	if max <= 0 {
+		return
+	}
+	if full := max <= n; full != wspool.full {
+		wspool.full = full
+		wspool.sendMeta(capacityEvent{Event: evCapacity, Full: full, Clients: n, MaxClients: max})
+	}
+}
+
+// sendMeta sends ev, as JSON, to every connection wanting meta events.
+func (wspool *Wspool) sendMeta(ev interface{}) {
+	frame, err := json.Marshal(ev)
+	if err != nil {
+		wspool.logger.Errorf("%s\n", err)
+		return
+	}
+	wspool.fanOut(broadcastPayload{payload: frame, match: consumer.wantsMeta})
+}
+
+// Publish packs m and broadcasts it to every connection that wants it, as a
+// Sink.  It mustn't be called once the pool is shutting down.
+func (wspool *Wspool) Publish(m serverMessage) error {
+	payload, err := packPayload(m, wspool.config.pack)
+	if err != nil {
+		return err
+	}
+	wspool.broadcast <- payload
+	return nil
+}
+
+// add registers conn with the pool, returning false, without blocking, if
+// the pool has stopped and never will.
+func (wspool *Wspool) add(conn consumer) bool {
+	select {
+	case wspool.register <- conn:
+		return true
+	case <-wspool.stopped:
+		return false
+	}
+}
+
+// remove unregisters conn from the pool, if it is still there.
+// Unlike sending on unregister, it doesn't block once the pool has stopped.
+func (wspool *Wspool) remove(conn consumer) {
+	select {
+	case wspool.unregister <- conn:
+	case <-wspool.stopped:
 	}
 }
 
 // handleBroadcast handles a broadcast request.
-func (wspool *Wspool) handleBroadcast(payload []byte, ok bool) {
+func (wspool *Wspool) handleBroadcast(payload broadcastPayload, ok bool) {
 	if !ok { // channel has been closed, shutdown
+		n := len(wspool.connections)
 		for conn := range wspool.connections {
-			wspool.closeConn(conn)
+			wspool.closeConn(conn, websocket.CloseGoingAway, "server shutting down")
 		}
+		wspool.logger.Infof("drained %d websocket connection(s)\n", n)
 		wspool.quit = true
+		return
+	}
+	// Some clients take an empty frame as a protocol error, and there's
+	// nothing in one for anyone else.
+	if len(payload.payload) == 0 {
+		wspool.logger.Debugf("not broadcasting empty message from %s\n", payload.server)
+		return
+	}
+	wspool.fanOut(payload)
+	wspool.sampleQueues()
+}
+
+// sampleQueues records how full every connection's queue is, for /metrics.
+func (wspool *Wspool) sampleQueues() {
+	for conn := range wspool.connections {
+		wspool.metrics.sampleQueue(conn.queued(), wspool.config.sendBuffer)
 	}
+}
+
+// fanOut sends payload to every connection that wants it, returning how many
+// got it: connections whose queues were full don't count.
+func (wspool *Wspool) fanOut(payload broadcastPayload) (n int) {
+	// Sends never block, so one slow connection can't hold up the rest;
+	// connections that are too slow are closed only once the fan-out is
+	// over, rather than while iterating over them.
+	var slow []consumer
 	for conn := range wspool.connections {
-		select {
-		case conn.send <- payload:
-		default:
-			wspool.closeConn(conn)
+		if payload.match != nil && !payload.match(conn) {
+			continue
+		}
+		sent, ok := wspool.sendTo(conn, payload)
+		if sent {
+			n++
+		}
+		if !ok {
+			slow = append(slow, conn)
+		}
+	}
+	for _, conn := range slow {
+		wspool.closeConn(conn, websocket.ClosePolicyViolation, "too slow")
+	}
+	return
+}
+
+// notification asks the pool to fan a payload out, as if it were broadcast,
+// and send back the number of connections that got it.
+type notification struct {
+	payload broadcastPayload
+	resCh   chan<- int
+}
+
+// notifyClients sends payload to the connections that want, and match, it,
+// returning how many did, or false if the pool has stopped.
+func (wspool *Wspool) notifyClients(payload broadcastPayload) (int, bool) {
+	resCh := make(chan int, 1)
+	select {
+	case wspool.notify <- notification{payload: payload, resCh: resCh}:
+		return <-resCh, true
+	case <-wspool.stopped:
+		return 0, false
+	}
+}
+
+// replay sends the current state snapshot to conn, which should have just
+// registered: as the pool handles broadcasts in order, conn then sees live
+// messages only after it has caught up.
+func (wspool *Wspool) replay(conn consumer) {
+	if wspool.config.greeting != nil {
+		if g := wspool.config.greeting(); g != nil {
+			// The queue is new, so this can't fail.
+			conn.send(broadcastPayload{payload: g})
+		}
+	}
+	wspool.replayServer(conn, "")
+}
+
+// connMeta is what the pool knows about each of its connections.
+type connMeta struct {
+	// since is when the connection registered.
+	since time.Time
+
+	// dropped is the number of messages the connection has missed, and
+	// streak the number it has missed since it last received one, which
+	// started at streakStart.
+	dropped     uint64
+	streak      int
+	streakStart time.Time
+}
+
+// connectionInfo describes a connection, for /admin/connections.
+type connectionInfo struct {
+	RemoteAddr string    `json:"remoteAddr"`
+	Since      time.Time `json:"since"`
+	CanCommand bool      `json:"canCommand"`
+	Dropped    uint64    `json:"dropped"`
+	// MaxRate is the most messages a second the connection asked for, or
+	// 0 if it asked for no limit.
+	MaxRate float64 `json:"maxRate,omitempty"`
+
+	// Subscriptions is nil if the connection receives every server's
+	// messages.
+	Subscriptions []string `json:"subscriptions"`
+	Only          []string `json:"only,omitempty"`
+	Except        []string `json:"except,omitempty"`
+}
+
+// connectionList returns a description of every connection in the pool,
+// sorted by when they connected, or false if the pool has stopped.
+func (wspool *Wspool) connectionList() ([]connectionInfo, bool) {
+	resCh := make(chan []connectionInfo, 1)
+	select {
+	case wspool.list <- resCh:
+		return <-resCh, true
+	case <-wspool.stopped:
+		return nil, false
+	}
+}
+
+// listConnections describes every connection in the pool.
+// Only the pool's own goroutine may call it; everything else should use
+// connectionList.
+func (wspool *Wspool) listConnections() []connectionInfo {
+	infos := make([]connectionInfo, 0, len(wspool.connections))
+	for conn, meta := range wspool.connections {
+		info := conn.info()
+		info.Since = meta.since
+		info.Dropped = meta.dropped
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Since.Before(infos[j].Since)
+	})
+	return infos
+}
+
+// resyncRequest asks the pool to send conn the current state snapshot of
+// server, or of every server if server is "".
+// If history is positive, it asks for that many of the latest messages
+// instead.
+type resyncRequest struct {
+	conn    consumer
+	server  string
+	history int
+}
+
+// replayServer sends the current state snapshot of server, or of every server
+// if server is "", to conn.
+func (wspool *Wspool) replayServer(conn consumer, server string) {
+	if wspool.config.snapshot == nil {
+		return
+	}
+	for _, payload := range wspool.config.snapshot() {
+		if server != "" && payload.server != server {
+			continue
+		}
+		if _, ok := wspool.sendTo(conn, payload); !ok {
+			// Sending any more would be sending on a closed channel.
+			wspool.closeConn(conn, websocket.ClosePolicyViolation, "too slow")
+			return
+		}
+	}
+}
+
+// replayHistory sends up to n of the latest messages from server, or from
+// every server if server is "", to conn.
+func (wspool *Wspool) replayHistory(conn consumer, server string, n int) {
+	if wspool.config.history == nil {
+		return
+	}
+	for _, payload := range wspool.config.history(server, n) {
+		if _, ok := wspool.sendTo(conn, payload); !ok {
+			// Sending any more would be sending on a closed channel.
+			wspool.closeConn(conn, websocket.ClosePolicyViolation, "too slow")
+			return
 		}
 	}
 }
 
-const (
+// sendTo sends payload to conn, if it is subscribed, without blocking.
+// It returns whether conn got payload, and, as ok, false if conn's queue was
+// full and it has now been falling behind for too long, in which case the
+// caller must close it.
+func (wspool *Wspool) sendTo(conn consumer, payload broadcastPayload) (sent, ok bool) {
+	if !conn.wants(payload) {
+		return false, true
+	}
+	meta := wspool.connections[conn]
+	if !conn.send(payload) {
+		return false, wspool.handleDrop(conn, meta)
+	}
+	if 0 < meta.streak {
+		wspool.logger.Infof("websocket %s caught up after missing %d\n", conn.addr(), meta.streak)
+		atomic.AddInt64(&wspool.metrics.falling, -1)
+	}
+	meta.streak = 0
+	return true, true
+}
+
+// handleDrop records, in meta, that conn missed a message because its queue
+// was full, returning false if it has been falling behind for too long.
+func (wspool *Wspool) handleDrop(conn consumer, meta *connMeta) bool {
+	now := time.Now()
+
+	meta.dropped++
+	atomic.AddUint64(&wspool.metrics.dropped, 1)
+	if meta.streak == 0 {
+		meta.streakStart = now
+		atomic.AddInt64(&wspool.metrics.falling, 1)
+		wspool.logger.Warnf("websocket %s falling behind (%d dropped in total)\n", conn.addr(), meta.dropped)
+	}
+	meta.streak++
+
+	tooMany := wspool.config.maxDrops < meta.streak
+	tooLong := 0 < wspool.config.dropGrace && wspool.config.dropGrace <= now.Sub(meta.streakStart)
+	if tooMany || tooLong {
+		wspool.logger.Warnf("websocket %s too slow, disconnecting (%d dropped in total)\n", conn.addr(), meta.dropped)
+		atomic.AddUint64(&wspool.metrics.slowDisconnects, 1)
+		return false
+	}
+	return true
+}
+
+// wsTimeouts holds the timeouts of a websocket connection.
+type wsTimeouts struct {
 	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
+	writeWait time.Duration
 
 	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
+	pongWait time.Duration
 
 	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-)
+	pingPeriod time.Duration
 
-// Wraps the websocket conn and a send channel in a handy struct which can
+	// If positive, send a heartbeat frame after this long without any
+	// data frames, for proxies that don't count pings as traffic.
+	heartbeat time.Duration
+
+	// If positive, collect broadcasts for this long after the first of a
+	// batch, then send them together in one frame (see batchFrame).
+	batchWindow time.Duration
+}
+
+// heartbeatFrame is the application-level heartbeat sent to idle clients.
+// Clients can ignore it.
+var heartbeatFrame = []byte(`{"event":"ping"}`)
+
+// Wraps the websocket conn and a send queue in a handy struct which can
 // be passed to the websocket pool
 type wsConn struct {
-	ws   *websocket.Conn
-	send chan []byte
+	ws       *websocket.Conn
+	queue    chan []byte
+	timeouts wsTimeouts
+
+	// remoteAddr is the client's address, as of the upgrade.
+	remoteAddr string
+
+	// closeCode and closeReason are sent in the close frame once queue is
+	// closed.  The pool sets them, just before closing queue.
+	closeCode   int
+	closeReason string
+	closeOnce   sync.Once
+
+	// frameType is the message type of frames taken from queue.  Replies
+	// are JSON, so are always text frames.
+	frameType int
+	// format, if not "", is the message format the client negotiated
+	// with a subprotocol, overriding the default.
+	format string
+
+	// reply carries frames meant for this connection only, such as
+	// errors in response to bad commands.  Unlike queue, the pool never
+	// closes it.
+	reply chan []byte
+
+	// canCommand is true if this connection may send commands.
+	canCommand bool
+	// readLimit, if positive, is the largest frame the client may send.
+	readLimit int64
+	// limiter limits the rate of commands.  Only the read loop touches
+	// it.
+	limiter *tokenBucket
+	// throttle holds back messages over any rate the client asked for.
+	// The pool offers it messages, and writeLoop sends those it held
+	// back.
+	throttle *throttle
+
+	// maxInFlight, if positive, is the most commands the client may have
+	// awaiting a response, and inFlight the number it has.  The
+	// upstream's goroutine releases them, so inFlight must be accessed
+	// atomically.
+	maxInFlight int
+	inFlight    int64
+
+	// The read loop changes the subscriptions and word filter as the
+	// client asks.
+	filter
+}
+
+// newWsConn wraps ws in a wsConn, with room to queue sendBuffer messages and
+// the given timeouts, subscribed to every server.
+func newWsConn(ws *websocket.Conn, sendBuffer int, timeouts wsTimeouts) *wsConn {
+	return &wsConn{
+		queue:      make(chan []byte, sendBuffer),
+		reply:      make(chan []byte, 16),
+		throttle:   newThrottle(sendBuffer),
+		ws:         ws,
+		remoteAddr: ws.RemoteAddr().String(),
+		timeouts:   timeouts,
+		frameType:  websocket.TextMessage,
+	}
+}
+
+// send queues payload, in the format the client negotiated, without
+// blocking, unless the throttle holds it back for writeLoop to send later.
+func (c *wsConn) send(payload broadcastPayload) bool {
+	if held, ok := c.throttle.hold(payload, time.Now(), len(c.queue)); held {
+		return ok
+	}
+	select {
+	case c.queue <- payload.in(c.format):
+		return true
+	default:
+		return false
+	}
+}
+
+// close makes the connection send a close frame with the given code and
+// reason, then hang up.  Only the pool may call it; calls after the first do
+// nothing.
+func (c *wsConn) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeReason = code, reason
+		close(c.queue)
+	})
+}
+
+// queued returns the number of frames waiting in the queue, including those
+// the throttle is holding back.
+func (c *wsConn) queued() int {
+	return len(c.queue) + c.throttle.len()
+}
+
+// addr returns the client's address, as of the upgrade.
+func (c *wsConn) addr() string {
+	return c.remoteAddr
+}
+
+// info describes the connection's address, rights and filters.
+func (c *wsConn) info() connectionInfo {
+	info := c.describe()
+	info.RemoteAddr = c.remoteAddr
+	info.CanCommand = c.canCommand
+	info.MaxRate = c.throttle.rate()
+	return info
+}
+
+// setWords lists the members of set in order, or returns nil if it is empty.
+func setWords(set map[string]bool) (words []string) {
+	for w := range set {
+		words = append(words, w)
+	}
+	sort.Strings(words)
+	return
+}
+
+// wsFrame is the structure of a frame sent by a client.
+// Command frames look like {"server":"main","command":["play"]}, and
+// subscription frames like {"subscribe":["main"]} or
+// {"unsubscribe":["preview"]}.
+type wsFrame struct {
+	Server  string   `json:"server"`
+	Command []string `json:"command"`
+	// ID, if set, asks for the server's response to Command to be sent
+	// back to this client in an ack frame carrying the same id.
+	ID string `json:"id"`
+
+	Subscribe   []string `json:"subscribe"`
+	Unsubscribe []string `json:"unsubscribe"`
+
+	// Only and Except replace the connection's word filter; an empty
+	// list removes it.
+	Only   []string `json:"only"`
+	Except []string `json:"except"`
+
+	// Resync asks for the current state snapshot of Server, or of every
+	// server if Server is empty, to be sent again.
+	Resync bool `json:"resync"`
+
+	// Meta, if set, turns meta events (about clients coming and going)
+	// on or off for this connection; they are off to begin with.
+	Meta *bool `json:"meta"`
+
+	// History asks for up to this many of the latest messages from
+	// Server, or from every server if Server is empty, oldest first.
+	History int `json:"history"`
+
+	// MaxRate, if set, limits this connection to that many messages a
+	// second, coalescing the rest (see throttle); 0 removes the limit.
+	MaxRate *float64 `json:"maxRate"`
+}
+
+// wsError is the structure of an error frame sent back to a client.
+type wsError struct {
+	Error string `json:"error"`
+}
+
+// wsAck is the structure of the frame sent back to a client with the
+// response to a command it sent with an id.
+type wsAck struct {
+	Event  string `json:"event"`
+	ID     string `json:"id"`
+	Server string `json:"server"`
+	// Response is the server's response, as a Bifrost line, or empty if
+	// none is coming, in which case Error says why.
+	Response string `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
 }
 
 // write writes a message with the given message type and payload.
+//
+// If compression was negotiated, the payload is compressed as it is written,
+// so the write deadline covers compressing it as well as sending it.  Large
+// payloads on slow machines may need a longer writeWait.
 func (c *wsConn) write(mt int, payload []byte) error {
-	if err := c.ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+	if err := c.ws.SetWriteDeadline(time.Now().Add(c.timeouts.writeWait)); err != nil {
 		return err
 	}
 	return c.ws.WriteMessage(mt, payload)
 }
 
-// writeLoop writes any messages coming down the send channel and pings the
-// client every pingPeriod
-func (c *wsConn) writeLoop() {
-	pingTicker := time.NewTicker(pingPeriod)
+// extendReadDeadline gives the client another pongWait to answer a ping.
+func (c *wsConn) extendReadDeadline() error {
+	return c.ws.SetReadDeadline(time.Now().Add(c.timeouts.pongWait))
+}
+
+// sendError queues an error frame for this connection only.
+// If the reply queue is full, the error is dropped rather than blocking the
+// read loop.
+func (c *wsConn) sendError(format string, a ...interface{}) {
+	c.sendReply(wsError{Error: fmt.Sprintf(format, a...)})
+}
+
+// sendReply queues v, as JSON, for this connection only, dropping it if the
+// reply queue is full.
+func (c *wsConn) sendReply(v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	select {
+	case c.reply <- j:
+	default:
+	}
+}
+
+// takeInFlight counts a command as awaiting a response, returning false,
+// and counting nothing, if the client already has maxInFlight.
+func (c *wsConn) takeInFlight() bool {
+	if int64(c.maxInFlight) < atomic.AddInt64(&c.inFlight, 1) {
+		atomic.AddInt64(&c.inFlight, -1)
+		return false
+	}
+	return true
+}
+
+// releasingInFlight wraps ack, which may be nil, so that the command stops
+// counting as in flight once its response arrives, or is known not to be
+// coming.
+func (c *wsConn) releasingInFlight(ack func(res *baps3.Message)) func(res *baps3.Message) {
+	return func(res *baps3.Message) {
+		atomic.AddInt64(&c.inFlight, -1)
+		if ack != nil {
+			ack(res)
+		}
+	}
+}
+
+// acker returns the ack for a command with the given id sent to server, which
+// sends the response back to this connection.
+func (c *wsConn) acker(server, id string) func(res *baps3.Message) {
+	return func(res *baps3.Message) {
+		ack := wsAck{Event: evAck, ID: id, Server: server}
+		if res == nil {
+			ack.Error = "no response from server"
+		} else if packed, err := res.Pack(); err != nil {
+			ack.Error = err.Error()
+		} else {
+			ack.Response = strings.TrimRight(string(packed), "\r\n")
+		}
+		c.sendReply(ack)
+	}
+}
+
+// readLoop reads frames from the client and handles them, until the
+// connection fails.
+//
+// A client that goes pongWait without answering a ping fails its read
+// deadline, ending the loop and unregistering it from the pool.
+func (c *wsConn) readLoop(connectors *connectorSet, wspool *Wspool) {
+	defer wspool.remove(c)
+
+	if 0 < c.readLimit {
+		// Going over this makes the websocket send close code 1009,
+		// and fails the read below.
+		c.ws.SetReadLimit(c.readLimit)
+	}
+	if err := c.extendReadDeadline(); err != nil {
+		return
+	}
+	c.ws.SetPongHandler(func(string) error {
+		return c.extendReadDeadline()
+	})
+
+	for {
+		_, payload, err := c.ws.ReadMessage()
+		if err == websocket.ErrReadLimit {
+			wspool.logger.Warnf("websocket %s sent a frame over %d bytes, disconnecting\n", c.remoteAddr, c.readLimit)
+		}
+		if err != nil {
+			return
+		}
+
+		var frame wsFrame
+		if err := json.Unmarshal(payload, &frame); err != nil {
+			c.sendError("malformed frame: %s", err)
+			continue
+		}
+		c.handleFrame(frame, connectors, wspool)
+	}
+}
+
+// handleFrame handles one frame from the client.
+func (c *wsConn) handleFrame(frame wsFrame, connectors *connectorSet, wspool *Wspool) {
+	if frame.Subscribe != nil || frame.Unsubscribe != nil {
+		c.handleSubscription(frame.Subscribe, frame.Unsubscribe, connectors)
+	}
+	if frame.Only != nil || frame.Except != nil {
+		c.handleFilter(frame.Only, frame.Except)
+	}
+	if frame.Command != nil {
+		c.handleCommand(frame.Server, frame.Command, frame.ID, connectors)
+	}
+	if frame.Resync {
+		c.handleResync(frame.Server, connectors, wspool)
+	}
+	if frame.Meta != nil {
+		c.setMeta(*frame.Meta)
+	}
+	if frame.History != 0 {
+		c.handleHistory(frame.Server, frame.History, connectors, wspool)
+	}
+	if frame.MaxRate != nil {
+		c.handleMaxRate(*frame.MaxRate)
+	}
+}
+
+// handleMaxRate limits this connection to rate messages a second, or, if
+// rate is 0, removes the limit.
+func (c *wsConn) handleMaxRate(rate float64) {
+	if rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		c.sendError("maxRate must be a non-negative number")
+		return
+	}
+	c.throttle.setRate(rate)
+}
+
+// handleSubscription adds the servers in sub to, and removes the servers in
+// unsub from, this connection's subscriptions.
+func (c *wsConn) handleSubscription(sub, unsub []string, connectors *connectorSet) {
+	c.subsLock.Lock()
+	defer c.subsLock.Unlock()
+
+	// Unsubscribing from 'everything' needs us to know what everything
+	// currently is.
+	if c.subs == nil && len(unsub) != 0 {
+		c.subs = make(map[string]bool)
+		for _, connector := range connectors.all() {
+			c.subs[connector.name] = true
+		}
+	}
+
+	for _, name := range sub {
+		if _, ok := connectors.get(name); !ok {
+			c.sendError("unknown server: %s", name)
+			continue
+		}
+		if c.subs != nil {
+			c.subs[name] = true
+		}
+	}
+	for _, name := range unsub {
+		delete(c.subs, name)
+	}
+}
+
+// handleFilter replaces this connection's word filter, so that it receives
+// only the messages with words in only or, if only is nil, all but those
+// with words in except.
+// The pool checks the filter as it sends each message, so the change takes
+// effect immediately.
+func (c *wsConn) handleFilter(only, except []string) {
+	c.subsLock.Lock()
+	defer c.subsLock.Unlock()
+
+	c.only, c.except = nil, nil
+	if len(only) != 0 {
+		c.only = wordSet(only)
+	} else if len(except) != 0 {
+		c.except = wordSet(except)
+	}
+}
+
+// wordSet makes a set out of the words in words.
+func wordSet(words []string) map[string]bool {
+	set := make(map[string]bool, len(words))
+	for _, w := range words {
+		set[w] = true
+	}
+	return set
+}
+
+// wordPermitted returns whether word gets through a filter letting through
+// only the words in allow, unless allow is nil, and none of those in deny.
+// Deny takes precedence over allow.
+func wordPermitted(word string, allow, deny map[string]bool) bool {
+	if deny[word] {
+		return false
+	}
+	return allow == nil || allow[word]
+}
+
+// handleResync asks wspool to send this connection the state snapshot of
+// server, or of every server if server is "".
+// The snapshot goes through the connection's subscriptions and filter as
+// usual, and to this connection only.
+func (c *wsConn) handleResync(server string, connectors *connectorSet, wspool *Wspool) {
+	if server != "" {
+		if _, ok := connectors.get(server); !ok {
+			c.sendError("unknown server: %s", server)
+			return
+		}
+	}
+	wspool.requestResync(resyncRequest{conn: c, server: server})
+}
+
+// requestResync passes rq to the pool, unless the pool has stopped, in which
+// case the connection is about to be closed anyway.
+func (wspool *Wspool) requestResync(rq resyncRequest) {
+	select {
+	case wspool.resync <- rq:
+	case <-wspool.stopped:
+	}
+}
+
+// handleHistory asks wspool to send this connection up to n of the latest
+// messages from server, or from every server if server is "".
+// Like a resync, the messages go through the connection's subscriptions and
+// filter, and to this connection only; as the pool handles requests in
+// order, live messages follow them.
+func (c *wsConn) handleHistory(server string, n int, connectors *connectorSet, wspool *Wspool) {
+	if wspool.config.history == nil {
+		c.sendError("history is disabled")
+		return
+	}
+	if n < 0 {
+		c.sendError("bad history length: %d", n)
+		return
+	}
+	if server != "" {
+		if _, ok := connectors.get(server); !ok {
+			c.sendError("unknown server: %s", server)
+			return
+		}
+	}
+	wspool.requestResync(resyncRequest{conn: c, server: server, history: n})
+}
+
+// handleCommand forwards command to the connector named server, and, if id
+// is set, sends the server's response back to this connection in an ack
+// frame.
+func (c *wsConn) handleCommand(server string, command []string, id string, connectors *connectorSet) {
+	if !c.canCommand {
+		c.sendError("not authorized to send commands")
+		return
+	}
+	if !c.limiter.allow(time.Now()) {
+		c.sendError("too many commands, slow down")
+		return
+	}
+	connector, ok := connectors.get(server)
+	if !ok {
+		c.sendError("unknown server: %s", server)
+		return
+	}
+	if connector.readOnly {
+		c.sendError("server is read-only: %s", server)
+		return
+	}
+	if len(command) == 0 {
+		c.sendError("empty command")
+		return
+	}
+	msg, err := baps3.LineToMessage(command)
+	if err != nil {
+		c.sendError("bad command: %s", err)
+		return
+	}
+	select {
+	case <-connector.done:
+		c.sendError("unknown server: %s", server)
+		return
+	default:
+	}
+	var ack func(*baps3.Message)
+	if id != "" {
+		ack = c.acker(server, id)
+	}
+	if 0 < c.maxInFlight {
+		if !c.takeInFlight() {
+			c.sendError("too many commands awaiting a response (at most %d)", c.maxInFlight)
+			return
+		}
+		ack = c.releasingInFlight(ack)
+	}
+	if err := connector.command(*msg, ack); err != nil {
+		// Rejected commands are never acked, so release this one here.
+		if 0 < c.maxInFlight {
+			atomic.AddInt64(&c.inFlight, -1)
+		}
+		c.sendError("can't send to %s: %s", server, err)
+	}
+}
+
+// writeLoop writes any messages coming down the send queue and pings the
+// client every pingPeriod.
+//
+// However it exits, the connection is unregistered from wspool straight away,
+// rather than waiting for the read loop or a full queue to notice.
+//
+// Slow clients are caught in two ways, which don't overlap.  The pool's drop
+// policy (MaxDrops and DropGrace) handles a client whose send queue stays
+// full, by closing the queue.  The write deadline (WriteWait) handles a socket
+// that stops taking data altogether, which would otherwise block writeLoop
+// forever; a write past it fails, and writeLoop gives up on the client.
+// If the pool closes the queue first, writeLoop still tries to send the close
+// frame, but that too is bounded by the write deadline.
+func (c *wsConn) writeLoop(wspool *Wspool) {
+	// If the pool closed the queue, it has already unregistered us, and ignores
+	// this.
+	defer wspool.remove(c)
+
+	pingTicker := time.NewTicker(c.timeouts.pingPeriod)
+
+	// heartbeat, if enabled, fires once no data has been written for the
+	// heartbeat interval.
+	var heartbeat <-chan time.Time
+	var heartbeatTimer *time.Timer
+	if 0 < c.timeouts.heartbeat {
+		heartbeatTimer = time.NewTimer(c.timeouts.heartbeat)
+		heartbeat = heartbeatTimer.C
+	}
+	// wrote puts the next heartbeat off after a data frame is written.
+	wrote := func() {
+		if heartbeatTimer == nil {
+			return
+		}
+		if !heartbeatTimer.Stop() {
+			select {
+			case <-heartbeatTimer.C:
+			default:
+			}
+		}
+		heartbeatTimer.Reset(c.timeouts.heartbeat)
+	}
+
+	// batch holds broadcasts waiting for the batch window, started by
+	// batchTimer, to close.
+	var batch [][]byte
+	var batchDue <-chan time.Time
+	var batchTimer *time.Timer
+	// flush sends any waiting broadcasts.
+	flush := func() error {
+		if batchTimer != nil {
+			batchTimer.Stop()
+		}
+		batchDue = nil
+		if len(batch) == 0 {
+			return nil
+		}
+		frame, err := batchFrame(batch)
+		batch = nil
+		if err != nil {
+			return err
+		}
+		if err := c.write(websocket.TextMessage, frame); err != nil {
+			return err
+		}
+		wrote()
+		return nil
+	}
+
+	// broadcast sends msg, a broadcast, or batches it up if batching.
+	broadcast := func(msg []byte) error {
+		if 0 < c.timeouts.batchWindow {
+			batch = append(batch, msg)
+			if batchDue == nil {
+				batchTimer = time.NewTimer(c.timeouts.batchWindow)
+				batchDue = batchTimer.C
+			}
+			return nil
+		}
+		if err := c.write(c.frameType, msg); err != nil {
+			return err
+		}
+		wrote()
+		return nil
+	}
+
+	// throttleDue fires, from throttleTimer, when the throttle next lets
+	// a held-back message go.
+	var throttleDue <-chan time.Time
+	var throttleTimer *time.Timer
+	// release sends every held-back message the throttle now lets go,
+	// then waits for the next.  The client may have changed its
+	// subscriptions or filter since they were held back, so they are
+	// checked again.
+	// Held-back messages are behind everything in the queue, so release
+	// waits until the queue is empty; taking the last message from it
+	// calls release again.
+	release := func() error {
+		if len(c.queue) != 0 {
+			return nil
+		}
+		if throttleTimer != nil {
+			throttleTimer.Stop()
+		}
+		throttleDue = nil
+		for {
+			p, ok, wait := c.throttle.next(time.Now())
+			if !ok {
+				if 0 < wait {
+					throttleTimer = time.NewTimer(wait)
+					throttleDue = throttleTimer.C
+				}
+				return nil
+			}
+			if !c.wants(p) {
+				continue
+			}
+			if err := broadcast(p.in(c.format)); err != nil {
+				return err
+			}
+		}
+	}
+
 	defer func() {
 		pingTicker.Stop()
-		// TODO(CaptainHayashi): use this error?
-		_ = c.ws.Close()
+		if heartbeatTimer != nil {
+			heartbeatTimer.Stop()
+		}
+		if batchTimer != nil {
+			batchTimer.Stop()
+		}
+		if throttleTimer != nil {
+			throttleTimer.Stop()
+		}
+		if err := c.ws.Close(); err != nil {
+			wspool.logger.Debugf("websocket %s: closing: %s\n", c.remoteAddr, err)
+		}
 	}()
+	// failed logs err, from a failed write.  A timeout means the socket
+	// has stopped draining, which is worth a warning and a count; anything
+	// else is most likely the client going away.
+	failed := func(err error) {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			atomic.AddUint64(&wspool.metrics.writeTimeouts, 1)
+			wspool.logger.Warnf("websocket %s: write timed out after %s, disconnecting\n", c.remoteAddr, c.timeouts.writeWait)
+			return
+		}
+		wspool.logger.Debugf("websocket %s: write failed: %s\n", c.remoteAddr, err)
+	}
+
 	for {
 		select {
-		case msg, ok := <-c.send:
+		case msg, ok := <-c.queue:
 			if !ok {
-				// TODO(CaptainHayashi): use this error?
-				_ = c.write(websocket.CloseMessage, []byte{})
+				if err := flush(); err != nil {
+					failed(err)
+					return
+				}
+				if err := c.write(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason)); err != nil {
+					wspool.logger.Debugf("websocket %s: sending close: %s\n", c.remoteAddr, err)
+				}
 				return
 			}
+			if err := broadcast(msg); err != nil {
+				failed(err)
+				return
+			}
+			if err := release(); err != nil {
+				failed(err)
+				return
+			}
+		case <-c.throttle.ready:
+			if err := release(); err != nil {
+				failed(err)
+				return
+			}
+		case <-throttleDue:
+			if err := release(); err != nil {
+				failed(err)
+				return
+			}
+		case <-batchDue:
+			if err := flush(); err != nil {
+				failed(err)
+				return
+			}
+		case msg := <-c.reply:
 			if err := c.write(websocket.TextMessage, msg); err != nil {
+				failed(err)
+				return
+			}
+			wrote()
+		case <-heartbeat:
+			if err := c.write(websocket.TextMessage, heartbeatFrame); err != nil {
+				failed(err)
 				return
 			}
+			// The timer has fired, so can be reset directly.
+			heartbeatTimer.Reset(c.timeouts.heartbeat)
 		case <-pingTicker.C:
 			if err := c.write(websocket.PingMessage, nil); err != nil {
+				failed(err)
 				return
 			}
 		}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/UniversityRadioYork/baps3-go"
+	"github.com/gorilla/websocket"
+)
+
+// dialTestWS opens a websocket to the /ws route of srv, closing it when the
+// test ends.
+func dialTestWS(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dialling: %s", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// TestPongTimeout checks that a client that stops answering pings is
+// disconnected once pongWait is up, while one that answers stays connected.
+func TestPongTimeout(t *testing.T) {
+	conf := defaultConfig().HTTP
+	conf.PingPeriod = duration{20 * time.Millisecond}
+	conf.PongWait = duration{100 * time.Millisecond}
+	wspool := startTestPool(t, conf)
+	srv := httptest.NewServer(initHTTP(conf, listener{Routes: []string{routeWS}}, time.Now(), newConnectorSet(), nil, wspool, nil, nil, testLogger()))
+	defer srv.Close()
+
+	// Pongs are only sent while reading, so one client reads, and the
+	// other never does.
+	awake := dialTestWS(t, srv)
+	go func() {
+		for {
+			if _, _, err := awake.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	dialTestWS(t, srv)
+	waitForConnections(t, wspool, 2)
+
+	waitForConnections(t, wspool, 1)
+	// Give the awake client a few more pongWaits to go wrong in.
+	time.Sleep(3 * conf.PongWait.Duration)
+	if n := len(connectionsOf(t, wspool)); n != 1 {
+		t.Errorf("got %d connections, want only the awake one", n)
+	}
+}
+
+// TestRegisterAfterStop checks that clients connecting once the pool has
+// stopped are turned away, rather than hanging their handlers forever.
+func TestRegisterAfterStop(t *testing.T) {
+	conf := defaultConfig().HTTP
+	wspool := startTestPool(t, conf)
+	stopTestPool(wspool)
+
+	srv := httptest.NewServer(initHTTP(conf, listener{Routes: []string{routeWS}}, time.Now(), newConnectorSet(), nil, wspool, nil, nil, testLogger()))
+	defer srv.Close()
+
+	// Neither handler should take anywhere near this long to hang up.
+	deadline := time.Now().Add(5 * time.Second)
+
+	ws := dialTestWS(t, srv)
+	ws.SetReadDeadline(deadline)
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("got %v, want a going away close", err)
+	}
+
+	client := srv.Client()
+	client.Timeout = time.Until(deadline)
+	res, err := client.Get(srv.URL + "/stream")
+	if err != nil {
+		t.Fatalf("streaming: %s", err)
+	}
+	defer res.Body.Close()
+	if _, err := io.ReadAll(res.Body); err != nil {
+		t.Errorf("stream didn't end: %s", err)
+	}
+}
+
+// countingConn counts the bytes read from a connection.
+type countingConn struct {
+	net.Conn
+	read int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+// TestCompressedSnapshot checks that, with compression on, a client offering
+// permessage-deflate gets it, and that a large snapshot replayed on connect
+// arrives intact, in text and binary frames, in far fewer bytes than it has.
+func TestCompressedSnapshot(t *testing.T) {
+	big := "FILE /" + strings.Repeat("jingles/", 1<<13) + "a.mp3"
+	tests := []struct {
+		name      string
+		binary    bool
+		frameType int
+	}{
+		{"text", false, websocket.TextMessage},
+		{"binary", true, websocket.BinaryMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := defaultConfig().HTTP
+			conf.Compression = true
+			conf.RawBroadcast = true
+			conf.Format = formatRaw
+			conf.BinaryFrames = tt.binary
+			config := testPoolConfig(conf)
+			config.snapshot = func() []broadcastPayload {
+				return []broadcastPayload{{server: "main", payload: []byte(big)}}
+			}
+			wspool := runTestPool(t, config)
+			srv := httptest.NewServer(initHTTP(conf, listener{Routes: []string{routeWS}}, time.Now(), newConnectorSet(), nil, wspool, nil, nil, testLogger()))
+			defer srv.Close()
+
+			var conn *countingConn
+			d := websocket.Dialer{
+				EnableCompression: true,
+				NetDial: func(network, addr string) (net.Conn, error) {
+					c, err := net.Dial(network, addr)
+					conn = &countingConn{Conn: c}
+					return conn, err
+				},
+			}
+			ws, res, err := d.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+			if err != nil {
+				t.Fatalf("dialling: %s", err)
+			}
+			defer ws.Close()
+			if ext := res.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+				t.Fatalf("got extensions %q, want permessage-deflate", ext)
+			}
+
+			if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			frameType, msg, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("reading the snapshot: %s", err)
+			}
+			if frameType != tt.frameType {
+				t.Errorf("got frame type %d, want %d", frameType, tt.frameType)
+			}
+			if string(msg) != big {
+				t.Errorf("snapshot arrived mangled, %d bytes instead of %d", len(msg), len(big))
+			}
+			if n := atomic.LoadInt64(&conn.read); len(big)/10 < int(n) {
+				t.Errorf("read %d bytes for a %d byte snapshot, so it wasn't compressed", n, len(big))
+			}
+		})
+	}
+}
+
+// TestResyncAfterStop checks that asking a stopped pool for a resync, or for
+// history, doesn't block the connection's read loop.
+func TestResyncAfterStop(t *testing.T) {
+	conf := defaultConfig().HTTP
+	wspool := startTestPool(t, conf)
+	stopTestPool(wspool)
+	wspool.config.history = func(string, int) []broadcastPayload { return nil }
+
+	c := &wsConn{reply: make(chan []byte, 16)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.handleResync("", newConnectorSet(), wspool)
+		c.handleHistory("", 10, newConnectorSet(), wspool)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resync blocked on a stopped pool")
+	}
+}
+
+// BenchmarkFanOut measures broadcasting one message to 1000 streams, half of
+// them subscribed to the message's server.
+func BenchmarkFanOut(b *testing.B) {
+	const conns, buffer = 1000, 256
+	wspool := NewWspool(wspoolConfig{sendBuffer: buffer, maxDrops: buffer}, nil, testLogger())
+	streams := make([]*streamConn, conns)
+	for i := range streams {
+		c := wspool.newStreamConn("127.0.0.1:1")
+		if i%2 == 0 {
+			c.subs = map[string]bool{"other": true}
+		}
+		streams[i] = c
+		wspool.connections[c] = &connMeta{since: time.Now()}
+	}
+	payload := broadcastPayload{server: "main", word: "TIME", payload: []byte("TIME 1234")}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if n := wspool.fanOut(payload); n != conns/2 {
+			b.Fatalf("sent to %d, want %d", n, conns/2)
+		}
+		if i%buffer == buffer-1 {
+			// Empty the queues, as their clients would.
+			b.StopTimer()
+			for _, c := range streams {
+				for len(c.queue) != 0 {
+					<-c.queue
+				}
+			}
+			b.StartTimer()
+		}
+	}
+}
+
+// TestWriteFailureUnregisters checks that a connection whose writes fail is
+// unregistered by its write loop, even with no read loop to notice the
+// client has gone.
+func TestWriteFailureUnregisters(t *testing.T) {
+	conf := defaultConfig().HTTP
+	// Stop the drop policy disconnecting the client instead.
+	conf.MaxDrops = 1 << 30
+	conf.DropGrace = duration{}
+	wspool := startTestPool(t, conf)
+	upgrader := newUpgrader(conf)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := wspool.newConn(ws)
+		if wspool.add(c) {
+			c.writeLoop(wspool)
+		}
+	}))
+	defer srv.Close()
+
+	ws := dialTestWS(t, srv)
+	waitForConnections(t, wspool, 1)
+	// Hang up without a close frame, as a client that crashed would.
+	ws.UnderlyingConn().Close()
+
+	payload := broadcastPayload{server: "main", word: "TIME", payload: []byte("TIME 1234")}
+	waitFor(t, "the connection to unregister", func() bool {
+		wspool.broadcast <- payload
+		return len(connectionsOf(t, wspool)) == 0
+	})
+}
+
+// TestStalledSocket checks that a client whose socket takes frames but never
+// drains them, so that writes eventually block, is disconnected by the write
+// deadline, and counted as a write timeout rather than by the drop policy.
+func TestStalledSocket(t *testing.T) {
+	conf := defaultConfig().HTTP
+	conf.WriteWait = duration{100 * time.Millisecond}
+	// Only the write deadline should disconnect the client.
+	conf.MaxDrops = 1 << 30
+	conf.DropGrace = duration{}
+	wspool := startTestPool(t, conf)
+	upgrader := newUpgrader(conf)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := wspool.newConn(ws)
+		if wspool.add(c) {
+			c.writeLoop(wspool)
+		}
+	}))
+	defer srv.Close()
+
+	// The client never reads, so the socket buffers fill up.
+	dialTestWS(t, srv)
+	waitForConnections(t, wspool, 1)
+
+	payload := broadcastPayload{server: "main", word: "FILE", payload: make([]byte, 1<<20)}
+	waitFor(t, "the connection to time out", func() bool {
+		wspool.broadcast <- payload
+		return len(connectionsOf(t, wspool)) == 0
+	})
+	if n := atomic.LoadUint64(&wspool.metrics.writeTimeouts); n != 1 {
+		t.Errorf("got %d write timeouts, want 1", n)
+	}
+	if n := atomic.LoadUint64(&wspool.metrics.slowDisconnects); n != 0 {
+		t.Errorf("got %d slow disconnects, want 0", n)
+	}
+}
+
+// TestInFlightCap checks that a client can have at most maxInFlight commands
+// awaiting a response, and gets room back as responses arrive, or as
+// commands are turned away or lost.
+func TestInFlightCap(t *testing.T) {
+	connectors := newConnectorSet()
+	upstream := &upstream{ReqCh: make(chan command, 1)}
+	connectors.add(&bfConnector{
+		name:          "main",
+		conn:          upstream,
+		done:          make(chan struct{}),
+		commandPolicy: commandReject,
+		logger:        testLogger(),
+	})
+	c := &wsConn{reply: make(chan []byte, 16), canCommand: true, maxInFlight: 2}
+
+	// reply returns the next frame sent back to the client, or "".
+	reply := func() string {
+		select {
+		case j := <-c.reply:
+			return string(j)
+		default:
+			return ""
+		}
+	}
+	// sent takes the next command from the upstream's queue.
+	sent := func() command {
+		select {
+		case rq := <-upstream.ReqCh:
+			return rq
+		default:
+			t.Fatal("no command queued")
+			return command{}
+		}
+	}
+	load := []string{"load", "/a.mp3"}
+	ok := baps3.NewMessage(baps3.RsOk).AddArg("load")
+
+	// Commands the upstream turns away, its queue being full, are
+	// released straight away, so don't use up the cap however many
+	// there are.
+	c.handleCommand("main", load, "1", connectors)
+	for i := 0; i < 3; i++ {
+		c.handleCommand("main", load, "", connectors)
+		if got := reply(); !strings.Contains(got, errCommandQueueFull.Error()) {
+			t.Fatalf("got %q, want the queue full", got)
+		}
+	}
+	first := sent()
+	c.handleCommand("main", load, "", connectors)
+	if got := reply(); got != "" {
+		t.Fatalf("got %s before reaching the cap", got)
+	}
+	second := sent()
+
+	c.handleCommand("main", load, "3", connectors)
+	if got := reply(); !strings.Contains(got, "too many commands awaiting a response") {
+		t.Fatalf("got %q past the cap, want an error", got)
+	}
+
+	// A response makes room, and still reaches the client.
+	first.ack(ok)
+	if got, want := reply(), `"id":"1"`; !strings.Contains(got, want) {
+		t.Errorf("got %q, want the ack of command 1", got)
+	}
+	c.handleCommand("main", load, "4", connectors)
+	if got := reply(); got != "" {
+		t.Fatalf("got %s after a response made room", got)
+	}
+	fourth := sent()
+
+	// So does a command never sent, as when the connection drops.
+	fourth.lost()
+	if got := reply(); !strings.Contains(got, "no response from server") {
+		t.Errorf("got %q, want command 4 reported lost", got)
+	}
+
+	second.ack(ok)
+	if got := atomic.LoadInt64(&c.inFlight); got != 0 {
+		t.Errorf("%d commands in flight after every response, want 0", got)
+	}
+}